@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"fmt"
+	"sheeva/config"
+	"sort"
+	"sync"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	ruleAccessLevel = "access_level"
+	ruleUser        = "user"
+	ruleGroup       = "group"
+	ruleDeployKey   = "deploy_key"
+)
+
+// accessRule is one entry of who may push, merge, unprotect or create on a
+// protected branch or tag: a role, a user, a group or a deploy key. Rules are
+// compared by kind and name, IDs are only needed to talk to the API.
+type accessRule struct {
+	Kind    string
+	Name    string
+	Level   gitlab.AccessLevelValue
+	RefID   int
+	EntryID int
+}
+
+func (r accessRule) key() string {
+	return r.Kind + ":" + r.Name
+}
+
+// apiAccessLevel is an access level of a protected branch or tag as returned
+// by the API. go-gitlab leaves out the deploy key.
+type apiAccessLevel struct {
+	ID          int                     `json:"id"`
+	AccessLevel gitlab.AccessLevelValue `json:"access_level"`
+	UserID      int                     `json:"user_id"`
+	GroupID     int                     `json:"group_id"`
+	DeployKeyID int                     `json:"deploy_key_id"`
+}
+
+// accessPermission is an entry of allowed_to_* lists. Entries with Destroy
+// set remove an existing rule when a protection is updated.
+type accessPermission struct {
+	ID          *int                     `url:"id,omitempty" json:"id,omitempty"`
+	UserID      *int                     `url:"user_id,omitempty" json:"user_id,omitempty"`
+	GroupID     *int                     `url:"group_id,omitempty" json:"group_id,omitempty"`
+	DeployKeyID *int                     `url:"deploy_key_id,omitempty" json:"deploy_key_id,omitempty"`
+	AccessLevel *gitlab.AccessLevelValue `url:"access_level,omitempty" json:"access_level,omitempty"`
+	Destroy     *bool                    `url:"_destroy,omitempty" json:"_destroy,omitempty"`
+}
+
+func newAccessPermission(r accessRule) *accessPermission {
+	switch r.Kind {
+	case ruleUser:
+		return &accessPermission{UserID: gitlab.Int(r.RefID)}
+	case ruleGroup:
+		return &accessPermission{GroupID: gitlab.Int(r.RefID)}
+	case ruleDeployKey:
+		return &accessPermission{DeployKeyID: gitlab.Int(r.RefID)}
+	}
+	return &accessPermission{AccessLevel: gitlab.AccessLevel(r.Level)}
+}
+
+// accessPermissions lists the entries creating the rules.
+func accessPermissions(rules []accessRule) []*accessPermission {
+	permissions := make([]*accessPermission, 0, len(rules))
+	for _, r := range rules {
+		permissions = append(permissions, newAccessPermission(r))
+	}
+	return permissions
+}
+
+// accessPermissionUpdates lists the entries turning the live rules into the
+// desired ones, or nil when they are the same.
+func accessPermissionUpdates(desired, live []accessRule) []*accessPermission {
+	liveKeys := make(map[string]bool, len(live))
+	for _, r := range live {
+		liveKeys[r.key()] = true
+	}
+	desiredKeys := make(map[string]bool, len(desired))
+	var permissions []*accessPermission
+	for _, r := range desired {
+		desiredKeys[r.key()] = true
+		if !liveKeys[r.key()] {
+			permissions = append(permissions, newAccessPermission(r))
+		}
+	}
+	for _, r := range live {
+		// Rules without an entry stand for a default GitLab did not return
+		if !desiredKeys[r.key()] && r.EntryID != 0 {
+			permissions = append(permissions, &accessPermission{ID: gitlab.Int(r.EntryID), Destroy: gitlab.Bool(true)})
+		}
+	}
+	return permissions
+}
+
+func sameAccessRules(desired, live []accessRule) bool {
+	if len(desired) != len(live) {
+		return false
+	}
+	keys := make(map[string]bool, len(live))
+	for _, r := range live {
+		keys[r.key()] = true
+	}
+	for _, r := range desired {
+		if !keys[r.key()] {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	usernames   = map[int]string{}
+	groupPaths  = map[int]string{}
+	namesByIDMu sync.Mutex
+)
+
+func lookupUsername(client *gitlab.Client, id int) (string, error) {
+	namesByIDMu.Lock()
+	defer namesByIDMu.Unlock()
+
+	if name, ok := usernames[id]; ok {
+		return name, nil
+	}
+	user, _, err := client.Users.GetUser(id, gitlab.GetUsersOptions{})
+	if err != nil {
+		return "", err
+	}
+	usernames[id] = user.Username
+	return user.Username, nil
+}
+
+func lookupGroupPath(client *gitlab.Client, id int) (string, error) {
+	namesByIDMu.Lock()
+	defer namesByIDMu.Unlock()
+
+	if path, ok := groupPaths[id]; ok {
+		return path, nil
+	}
+	group, _, err := client.Groups.GetGroup(id, &gitlab.GetGroupOptions{WithProjects: gitlab.Bool(false)})
+	if err != nil {
+		return "", err
+	}
+	groupPaths[id] = group.FullPath
+	return group.FullPath, nil
+}
+
+// accessResolver translates the users, groups and deploy keys of access
+// rules of one project between names and IDs.
+type accessResolver struct {
+	client     *gitlab.Client
+	projectID  int
+	deployKeys map[string]int
+}
+
+func newAccessResolver(client *gitlab.Client, projectID int) *accessResolver {
+	return &accessResolver{client: client, projectID: projectID}
+}
+
+func (r *accessResolver) loadDeployKeys() error {
+	if r.deployKeys != nil {
+		return nil
+	}
+	keys := map[string]int{}
+	opts := &gitlab.ListProjectDeployKeysOptions{PerPage: 100}
+	for {
+		page, resp, err := r.client.DeployKeys.ListProjectDeployKeys(r.projectID, opts)
+		if err != nil {
+			return err
+		}
+		for _, k := range page {
+			keys[k.Title] = k.ID
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	r.deployKeys = keys
+	return nil
+}
+
+func (r *accessResolver) deployKeyID(title string) (int, error) {
+	if err := r.loadDeployKeys(); err != nil {
+		return 0, err
+	}
+	id, ok := r.deployKeys[title]
+	if !ok {
+		return 0, fmt.Errorf("deploy key '%s' is not enabled for the project", title)
+	}
+	return id, nil
+}
+
+func (r *accessResolver) deployKeyTitle(id int) (string, error) {
+	if err := r.loadDeployKeys(); err != nil {
+		return "", err
+	}
+	for title, keyID := range r.deployKeys {
+		if keyID == id {
+			return title, nil
+		}
+	}
+	return "", fmt.Errorf("deploy key %d is not enabled for the project", id)
+}
+
+// desired builds the rules of one action. Without any level or allowed
+// entries GitLab grants the action to the default level, with allowed
+// entries only no role is granted it.
+func (r *accessResolver) desired(level string, defaultLevel gitlab.AccessLevelValue, allowed []config.AllowedAccess) ([]accessRule, error) {
+	var rules []accessRule
+	switch {
+	case level != "":
+		value, err := config.ParseProtectionLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, accessRule{Kind: ruleAccessLevel, Name: config.ProtectionLevelName(value), Level: value})
+	case len(allowed) == 0:
+		rules = append(rules, accessRule{Kind: ruleAccessLevel, Name: config.ProtectionLevelName(defaultLevel), Level: defaultLevel})
+	default:
+		rules = append(rules, accessRule{Kind: ruleAccessLevel, Name: config.ProtectionLevelName(gitlab.NoPermissions), Level: gitlab.NoPermissions})
+	}
+
+	for _, a := range allowed {
+		var rule accessRule
+		var err error
+		switch {
+		case a.User != "":
+			rule = accessRule{Kind: ruleUser, Name: a.User}
+			rule.RefID, err = lookupUserID(r.client, a.User)
+		case a.Group != "":
+			rule = accessRule{Kind: ruleGroup, Name: a.Group}
+			rule.RefID, err = GetGroupID(a.Group, r.client)
+		default:
+			rule = accessRule{Kind: ruleDeployKey, Name: a.DeployKey}
+			rule.RefID, err = r.deployKeyID(a.DeployKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// live converts the access levels returned by the API. GitLab Free does not
+// return every list, a missing one means the default level.
+func (r *accessResolver) live(levels []apiAccessLevel, defaultLevel gitlab.AccessLevelValue) ([]accessRule, error) {
+	if len(levels) == 0 {
+		return []accessRule{{Kind: ruleAccessLevel, Name: config.ProtectionLevelName(defaultLevel), Level: defaultLevel}}, nil
+	}
+
+	var rules []accessRule
+	for _, l := range levels {
+		var rule accessRule
+		var err error
+		switch {
+		case l.UserID != 0:
+			rule = accessRule{Kind: ruleUser, RefID: l.UserID}
+			rule.Name, err = lookupUsername(r.client, l.UserID)
+		case l.GroupID != 0:
+			rule = accessRule{Kind: ruleGroup, RefID: l.GroupID}
+			rule.Name, err = lookupGroupPath(r.client, l.GroupID)
+		case l.DeployKeyID != 0:
+			rule = accessRule{Kind: ruleDeployKey, RefID: l.DeployKeyID}
+			rule.Name, err = r.deployKeyTitle(l.DeployKeyID)
+		default:
+			rule = accessRule{Kind: ruleAccessLevel, Name: config.ProtectionLevelName(l.AccessLevel), Level: l.AccessLevel}
+		}
+		if err != nil {
+			return nil, err
+		}
+		rule.EntryID = l.ID
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// accessConfig converts rules back to the YAML form.
+func accessConfig(rules []accessRule) (string, []config.AllowedAccess) {
+	var level string
+	var allowed []config.AllowedAccess
+	for _, r := range rules {
+		switch r.Kind {
+		case ruleAccessLevel:
+			if level == "" {
+				level = r.Name
+			}
+		case ruleUser:
+			allowed = append(allowed, config.AllowedAccess{User: r.Name})
+		case ruleGroup:
+			allowed = append(allowed, config.AllowedAccess{Group: r.Name})
+		case ruleDeployKey:
+			allowed = append(allowed, config.AllowedAccess{DeployKey: r.Name})
+		}
+	}
+	sort.Slice(allowed, func(i, j int) bool {
+		return allowed[i].User+allowed[i].Group+allowed[i].DeployKey < allowed[j].User+allowed[j].Group+allowed[j].DeployKey
+	})
+	return level, allowed
+}
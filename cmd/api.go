@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// doRequest calls an endpoint go-gitlab does not cover, or covers without
+// the attributes needed. The response body is discarded.
+func doRequest(client *gitlab.Client, method, path string, opt interface{}) error {
+	var options []gitlab.RequestOptionFunc
+	// go-gitlab sends a JSON body for POST and PUT only
+	if method == http.MethodPatch {
+		options = append(options, jsonBody(opt))
+		opt = nil
+	}
+	req, err := client.NewRequest(method, path, opt, options)
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(req, nil)
+	return err
+}
+
+func jsonBody(opt interface{}) gitlab.RequestOptionFunc {
+	return func(req *retryablehttp.Request) error {
+		body, err := json.Marshal(opt)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req.SetBody(body)
+	}
+}
+
+// isUnavailable reports whether a request failed because the feature is not
+// available, like a Premium feature on GitLab Free.
+func isUnavailable(err error) bool {
+	var errResp *gitlab.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response == nil {
+		return false
+	}
+	return errResp.Response.StatusCode == http.StatusForbidden || errResp.Response.StatusCode == http.StatusNotFound
+}
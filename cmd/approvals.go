@@ -0,0 +1,546 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sheeva/config"
+	"sort"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	approvalsKind    = "approvals"
+	approvalRuleKind = "approval_rule"
+)
+
+// approvalSettings are the live approval settings of a project or group,
+// named as in the YAML.
+type approvalSettings struct {
+	ApprovalsBeforeMerge     int
+	ResetApprovalsOnPush     bool
+	PreventAuthorApproval    bool
+	PreventCommitterApproval bool
+	RequirePassword          bool
+}
+
+// approvalSettingChanges lists the managed settings which differ from the
+// live ones.
+func approvalSettingChanges(desired config.Approvals, live approvalSettings) []string {
+	var changes []string
+	if desired.ApprovalsBeforeMerge != nil && *desired.ApprovalsBeforeMerge != live.ApprovalsBeforeMerge {
+		changes = append(changes, "approvals_before_merge")
+	}
+	flags := []struct {
+		name    string
+		desired *bool
+		live    bool
+	}{
+		{"reset_approvals_on_push", desired.ResetApprovalsOnPush, live.ResetApprovalsOnPush},
+		{"prevent_author_approval", desired.PreventAuthorApproval, live.PreventAuthorApproval},
+		{"prevent_committer_approval", desired.PreventCommitterApproval, live.PreventCommitterApproval},
+		{"require_password", desired.RequirePassword, live.RequirePassword},
+	}
+	for _, f := range flags {
+		if f.desired != nil && *f.desired != f.live {
+			changes = append(changes, f.name)
+		}
+	}
+	return changes
+}
+
+// approvalRule is a regular approval rule with its users, groups and
+// protected branches sorted by name.
+type approvalRule struct {
+	ID                int
+	Name              string
+	ApprovalsRequired int
+	Users             []string
+	Groups            []string
+	Branches          []string
+	UserIDs           []int
+	GroupIDs          []int
+	BranchIDs         []int
+}
+
+func (r approvalRule) toConfig() config.ApprovalRule {
+	return config.ApprovalRule{
+		Name:              r.Name,
+		ApprovalsRequired: r.ApprovalsRequired,
+		Users:             r.Users,
+		Groups:            r.Groups,
+		ProtectedBranches: r.Branches,
+	}
+}
+
+func sortedNames(names []string) []string {
+	sorted := append([]string(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return strings.ToLower(sorted[i]) < strings.ToLower(sorted[j]) })
+	return sorted
+}
+
+// sameNames compares sorted usernames or group paths, which GitLab treats
+// case insensitively.
+func sameNames(desired, live []string) bool {
+	if len(desired) != len(live) {
+		return false
+	}
+	for i := range desired {
+		if !strings.EqualFold(desired[i], live[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func approvalRuleChanges(desired, live approvalRule) []string {
+	var changes []string
+	if desired.ApprovalsRequired != live.ApprovalsRequired {
+		changes = append(changes, "approvals_required")
+	}
+	if !sameNames(desired.Users, live.Users) {
+		changes = append(changes, "users")
+	}
+	if !sameNames(desired.Groups, live.Groups) {
+		changes = append(changes, "groups")
+	}
+	if strings.Join(desired.Branches, ",") != strings.Join(live.Branches, ",") {
+		changes = append(changes, "protected_branches")
+	}
+	return changes
+}
+
+// approvalChange is a planned change together with the desired settings or
+// rule.
+type approvalChange struct {
+	plannedChange
+	Settings config.Approvals
+	Rule     approvalRule
+}
+
+func manageApprovals(element config.GitlabElement) bool {
+	return element.Approvals != nil
+}
+
+func liveProjectApprovals(projectId int, client *gitlab.Client) (approvalSettings, error) {
+	live, _, err := client.Projects.GetApprovalConfiguration(projectId)
+	if err != nil {
+		return approvalSettings{}, err
+	}
+	return approvalSettings{
+		ApprovalsBeforeMerge:     live.ApprovalsBeforeMerge,
+		ResetApprovalsOnPush:     live.ResetApprovalsOnPush,
+		PreventAuthorApproval:    !live.MergeRequestsAuthorApproval,
+		PreventCommitterApproval: live.MergeRequestsDisableCommittersApproval,
+		RequirePassword:          live.RequirePasswordToApprove,
+	}, nil
+}
+
+// listApprovalRules returns the regular rules of the project. Code owner and
+// security rules are maintained by GitLab and left alone.
+func listApprovalRules(projectId int, client *gitlab.Client) ([]approvalRule, error) {
+	var rules []approvalRule
+	opts := &gitlab.GetProjectApprovalRulesListsOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Projects.GetProjectApprovalRules(projectId, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			if r.RuleType != "" && r.RuleType != "regular" {
+				continue
+			}
+			rule := approvalRule{ID: r.ID, Name: r.Name, ApprovalsRequired: r.ApprovalsRequired}
+			for _, u := range r.Users {
+				rule.Users = append(rule.Users, u.Username)
+			}
+			for _, g := range r.Groups {
+				rule.Groups = append(rule.Groups, g.FullPath)
+			}
+			for _, b := range r.ProtectedBranches {
+				rule.Branches = append(rule.Branches, b.Name)
+			}
+			rule.Users, rule.Groups, rule.Branches = sortedNames(rule.Users), sortedNames(rule.Groups), sortedNames(rule.Branches)
+			rules = append(rules, rule)
+		}
+		if resp.NextPage == 0 {
+			return rules, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// desiredApprovalRule resolves the users, groups and protected branches of a
+// rule. branches maps the protected branches of the project to their IDs.
+func desiredApprovalRule(r config.ApprovalRule, branches map[string]int, client *gitlab.Client) (approvalRule, error) {
+	rule := approvalRule{
+		Name:              r.Name,
+		ApprovalsRequired: r.ApprovalsRequired,
+		Users:             sortedNames(r.Users),
+		Groups:            sortedNames(r.Groups),
+		Branches:          sortedNames(r.ProtectedBranches),
+		UserIDs:           []int{},
+		GroupIDs:          []int{},
+		BranchIDs:         []int{},
+	}
+	for _, username := range rule.Users {
+		id, err := lookupUserID(client, username)
+		if err != nil {
+			return rule, err
+		}
+		rule.UserIDs = append(rule.UserIDs, id)
+	}
+	for _, group := range rule.Groups {
+		id, err := GetGroupID(group, client)
+		if err != nil {
+			return rule, err
+		}
+		rule.GroupIDs = append(rule.GroupIDs, id)
+	}
+	for _, name := range rule.Branches {
+		id, ok := branches[name]
+		if !ok {
+			return rule, fmt.Errorf("branch '%s' is not protected", name)
+		}
+		rule.BranchIDs = append(rule.BranchIDs, id)
+	}
+	return rule, nil
+}
+
+func protectedBranchIDs(projectId int, client *gitlab.Client) (map[string]int, error) {
+	branches, err := listProtectedBranches(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int, len(branches))
+	for _, b := range branches {
+		ids[b.Name] = b.ID
+	}
+	return ids, nil
+}
+
+func projectApprovalChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]approvalChange, error) {
+	target := elementPath(project)
+	desired := *project.Approvals
+	var changes []approvalChange
+
+	live, err := liveProjectApprovals(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	if attributes := approvalSettingChanges(desired, live); len(attributes) > 0 {
+		changes = append(changes, approvalChange{
+			plannedChange: plannedChange{Action: actionUpdate, Kind: approvalsKind, Target: target, Changes: attributes},
+			Settings:      desired,
+		})
+	}
+
+	if len(desired.Rules) == 0 && !desired.CleanUnmanagedRules {
+		return changes, nil
+	}
+	liveRules, err := listApprovalRules(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	branches, err := protectedBranchIDs(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	liveByName := make(map[string]approvalRule, len(liveRules))
+	for _, r := range liveRules {
+		liveByName[r.Name] = r
+	}
+
+	desiredNames := make(map[string]bool, len(desired.Rules))
+	for _, r := range desired.Rules {
+		desiredNames[r.Name] = true
+		rule, err := desiredApprovalRule(r, branches, client)
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": target,
+				"Rule":    r.Name,
+			}).Error("Error while resolving approval rule")
+			continue
+		}
+
+		current, ok := liveByName[r.Name]
+		if !ok {
+			changes = append(changes, approvalChange{
+				plannedChange: plannedChange{Action: actionCreate, Kind: approvalRuleKind, Target: target, Name: r.Name},
+				Rule:          rule,
+			})
+			continue
+		}
+		if attributes := approvalRuleChanges(rule, current); len(attributes) > 0 {
+			rule.ID = current.ID
+			changes = append(changes, approvalChange{
+				plannedChange: plannedChange{Action: actionUpdate, Kind: approvalRuleKind, Target: target, Name: r.Name, Changes: attributes},
+				Rule:          rule,
+			})
+		}
+	}
+
+	if desired.CleanUnmanagedRules {
+		for _, r := range liveRules {
+			if !desiredNames[r.Name] {
+				changes = append(changes, approvalChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: approvalRuleKind, Target: target, Name: r.Name},
+					Rule:          r,
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+func ManageProjectApprovals(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if !manageApprovals(project) {
+		return nil
+	}
+	changes, err := projectApprovalChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch {
+		case change.Kind == approvalsKind:
+			err = UpdateProjectApprovals(projectId, change.Settings, client)
+		case change.Action == actionCreate:
+			err = CreateApprovalRule(projectId, change.Rule, client)
+		case change.Action == actionUpdate:
+			err = UpdateApprovalRule(projectId, change.Rule, client)
+		case change.Action == actionDelete:
+			_, err = client.Projects.DeleteProjectApprovalRule(projectId, change.Rule.ID)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": elementPath(project),
+				"Action":  change.Action,
+				"Kind":    change.Kind,
+				"Name":    change.Name,
+			}).Warning("Error ocured while changing approvals")
+		}
+	}
+	return nil
+}
+
+func UpdateProjectApprovals(projectId int, approvals config.Approvals, client *gitlab.Client) error {
+	opt := &gitlab.ChangeApprovalConfigurationOptions{
+		ApprovalsBeforeMerge:                   approvals.ApprovalsBeforeMerge,
+		ResetApprovalsOnPush:                   approvals.ResetApprovalsOnPush,
+		MergeRequestsDisableCommittersApproval: approvals.PreventCommitterApproval,
+		RequirePasswordToApprove:               approvals.RequirePassword,
+	}
+	if approvals.PreventAuthorApproval != nil {
+		opt.MergeRequestsAuthorApproval = gitlab.Bool(!*approvals.PreventAuthorApproval)
+	}
+	_, _, err := client.Projects.ChangeApprovalConfiguration(projectId, opt)
+	return err
+}
+
+func CreateApprovalRule(projectId int, rule approvalRule, client *gitlab.Client) error {
+	_, _, err := client.Projects.CreateProjectApprovalRule(projectId, &gitlab.CreateProjectLevelRuleOptions{
+		Name:               gitlab.String(rule.Name),
+		ApprovalsRequired:  gitlab.Int(rule.ApprovalsRequired),
+		UserIDs:            &rule.UserIDs,
+		GroupIDs:           &rule.GroupIDs,
+		ProtectedBranchIDs: &rule.BranchIDs,
+	})
+	return err
+}
+
+func UpdateApprovalRule(projectId int, rule approvalRule, client *gitlab.Client) error {
+	_, _, err := client.Projects.UpdateProjectApprovalRule(projectId, rule.ID, &gitlab.UpdateProjectLevelRuleOptions{
+		Name:               gitlab.String(rule.Name),
+		ApprovalsRequired:  gitlab.Int(rule.ApprovalsRequired),
+		UserIDs:            &rule.UserIDs,
+		GroupIDs:           &rule.GroupIDs,
+		ProtectedBranchIDs: &rule.BranchIDs,
+	})
+	return err
+}
+
+// apiGroupApprovalSetting is a group approval setting as returned by the
+// API, which also tells whether it is locked by a parent.
+type apiGroupApprovalSetting struct {
+	Value bool `json:"value"`
+}
+
+type apiGroupApprovalSettings struct {
+	AllowAuthorApproval      apiGroupApprovalSetting `json:"allow_author_approval"`
+	AllowCommitterApproval   apiGroupApprovalSetting `json:"allow_committer_approval"`
+	RetainApprovalsOnPush    apiGroupApprovalSetting `json:"retain_approvals_on_push"`
+	RequirePasswordToApprove apiGroupApprovalSetting `json:"require_password_to_approve"`
+}
+
+type updateGroupApprovalsRequest struct {
+	AllowAuthorApproval      *bool `url:"allow_author_approval,omitempty" json:"allow_author_approval,omitempty"`
+	AllowCommitterApproval   *bool `url:"allow_committer_approval,omitempty" json:"allow_committer_approval,omitempty"`
+	RetainApprovalsOnPush    *bool `url:"retain_approvals_on_push,omitempty" json:"retain_approvals_on_push,omitempty"`
+	RequirePasswordToApprove *bool `url:"require_password_to_approve,omitempty" json:"require_password_to_approve,omitempty"`
+}
+
+func groupApprovalsPath(groupID int) string {
+	return fmt.Sprintf("groups/%d/merge_request_approval_setting", groupID)
+}
+
+func liveGroupApprovals(groupID int, client *gitlab.Client) (approvalSettings, error) {
+	req, err := client.NewRequest(http.MethodGet, groupApprovalsPath(groupID), nil, nil)
+	if err != nil {
+		return approvalSettings{}, err
+	}
+	var live apiGroupApprovalSettings
+	if _, err := client.Do(req, &live); err != nil {
+		return approvalSettings{}, err
+	}
+	return approvalSettings{
+		ResetApprovalsOnPush:     !live.RetainApprovalsOnPush.Value,
+		PreventAuthorApproval:    !live.AllowAuthorApproval.Value,
+		PreventCommitterApproval: !live.AllowCommitterApproval.Value,
+		RequirePassword:          live.RequirePasswordToApprove.Value,
+	}, nil
+}
+
+func negate(b *bool) *bool {
+	if b == nil {
+		return nil
+	}
+	return gitlab.Bool(!*b)
+}
+
+func groupApprovalChanges(groupID int, group config.GitlabElement, client *gitlab.Client) ([]approvalChange, error) {
+	live, err := liveGroupApprovals(groupID, client)
+	if err != nil {
+		return nil, err
+	}
+	attributes := approvalSettingChanges(*group.Approvals, live)
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+	return []approvalChange{{
+		plannedChange: plannedChange{Action: actionUpdate, Kind: approvalsKind, Target: elementPath(group), Changes: attributes},
+		Settings:      *group.Approvals,
+	}}, nil
+}
+
+func ManageGroupApprovals(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	if !manageApprovals(group) {
+		return nil
+	}
+	changes, err := groupApprovalChanges(groupID, group, client)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if err := UpdateGroupApprovals(groupID, change.Settings, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error": err,
+				"Group": elementPath(group),
+			}).Warning("Error ocured while changing approvals")
+		}
+	}
+	return nil
+}
+
+// UpdateGroupApprovals changes the defaults of the projects in the group.
+func UpdateGroupApprovals(groupID int, approvals config.Approvals, client *gitlab.Client) error {
+	return doRequest(client, http.MethodPut, groupApprovalsPath(groupID), updateGroupApprovalsRequest{
+		AllowAuthorApproval:      negate(approvals.PreventAuthorApproval),
+		AllowCommitterApproval:   negate(approvals.PreventCommitterApproval),
+		RetainApprovalsOnPush:    negate(approvals.ResetApprovalsOnPush),
+		RequirePasswordToApprove: approvals.RequirePassword,
+	})
+}
+
+func planProjectApprovals(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if !manageApprovals(project) {
+		return nil, nil
+	}
+	changes, err := projectApprovalChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func planGroupApprovals(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	if !manageApprovals(group) {
+		return nil, nil
+	}
+	changes, err := groupApprovalChanges(groupID, group, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importedApprovals(live approvalSettings) *config.Approvals {
+	return &config.Approvals{
+		ResetApprovalsOnPush:     gitlab.Bool(live.ResetApprovalsOnPush),
+		PreventAuthorApproval:    gitlab.Bool(live.PreventAuthorApproval),
+		PreventCommitterApproval: gitlab.Bool(live.PreventCommitterApproval),
+		RequirePassword:          gitlab.Bool(live.RequirePassword),
+	}
+}
+
+// importProjectApprovals skips approvals on instances without them, so
+// projects of GitLab Free can still be imported.
+func importProjectApprovals(project *config.GitlabElement, projectId int) error {
+	live, err := liveProjectApprovals(projectId, gitlabClient)
+	if isUnavailable(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rules, err := listApprovalRules(projectId, gitlabClient)
+	if err != nil && !isUnavailable(err) {
+		return err
+	}
+
+	approvals := importedApprovals(live)
+	approvals.ApprovalsBeforeMerge = gitlab.Int(live.ApprovalsBeforeMerge)
+	for _, r := range rules {
+		approvals.Rules = append(approvals.Rules, r.toConfig())
+	}
+	approvals.CleanUnmanagedRules = len(rules) > 0
+	project.Approvals = approvals
+	return nil
+}
+
+func importGroupApprovals(group *config.GitlabElement, groupID int) error {
+	live, err := liveGroupApprovals(groupID, gitlabClient)
+	if isUnavailable(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	group.Approvals = importedApprovals(live)
+	return nil
+}
+
+// approvalRules reports approval settings which cannot be applied. Groups
+// only hold the defaults of their projects.
+func approvalRules(kind string, element config.GitlabElement) []validationIssue {
+	if element.Approvals == nil {
+		return nil
+	}
+	target := elementPath(element)
+	var issues []validationIssue
+	if kind == groupKind {
+		if element.Approvals.ApprovalsBeforeMerge != nil || len(element.Approvals.Rules) > 0 || element.Approvals.CleanUnmanagedRules {
+			issues = append(issues, validationIssue{Target: target, Field: "approvals", Message: "Approval rules and approvals_before_merge are only supported on projects", Fatal: true})
+		}
+	}
+	for _, problem := range config.CheckApprovals(*element.Approvals) {
+		issues = append(issues, validationIssue{Target: target, Field: "approvals", Message: problem, Fatal: true})
+	}
+	return issues
+}
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const badgeKind = "badge"
+
+// apiBadge is a badge as returned by the API. go-gitlab does not know the
+// name of group badges, so badges are called directly.
+type apiBadge struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	LinkURL  string `json:"link_url"`
+	ImageURL string `json:"image_url"`
+	Kind     string `json:"kind"`
+}
+
+type badgeRequest struct {
+	Name     *string `url:"name,omitempty" json:"name,omitempty"`
+	LinkURL  *string `url:"link_url,omitempty" json:"link_url,omitempty"`
+	ImageURL *string `url:"image_url,omitempty" json:"image_url,omitempty"`
+}
+
+// badgeOwner is the project or group holding badges. kind filters out the
+// badges a project inherits from its groups.
+type badgeOwner struct {
+	path string
+	kind string
+}
+
+func projectBadges(projectId int) badgeOwner {
+	return badgeOwner{path: fmt.Sprintf("projects/%d/badges", projectId), kind: projectKind}
+}
+
+func groupBadges(groupID int) badgeOwner {
+	return badgeOwner{path: fmt.Sprintf("groups/%d/badges", groupID), kind: groupKind}
+}
+
+func listBadges(owner badgeOwner, client *gitlab.Client) ([]apiBadge, error) {
+	var badges []apiBadge
+	opts := &gitlab.ListOptions{PerPage: 100}
+	for {
+		req, err := client.NewRequest(http.MethodGet, owner.path, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []apiBadge
+		resp, err := client.Do(req, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range page {
+			if b.Kind == "" || b.Kind == owner.kind {
+				badges = append(badges, b)
+			}
+		}
+		if resp.NextPage == 0 {
+			return badges, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// badgeChange is a planned change together with the desired badge and the
+// ID of the live one.
+type badgeChange struct {
+	plannedChange
+	Badge  config.Badge
+	LiveID int
+}
+
+// badgeChanges compares the badges with the live ones by name.
+func badgeChanges(owner badgeOwner, element config.GitlabElement, client *gitlab.Client) ([]badgeChange, error) {
+	target := elementPath(element)
+	live, err := listBadges(owner, client)
+	if err != nil {
+		return nil, err
+	}
+	liveByName := make(map[string]apiBadge, len(live))
+	for _, b := range live {
+		liveByName[b.Name] = b
+	}
+
+	var changes []badgeChange
+	desiredNames := make(map[string]bool, len(element.Badges))
+	for _, b := range element.Badges {
+		desiredNames[b.Name] = true
+		change := badgeChange{
+			plannedChange: plannedChange{Kind: badgeKind, Target: target, Name: b.Name},
+			Badge:         b,
+		}
+		current, ok := liveByName[b.Name]
+		if !ok {
+			change.Action = actionCreate
+			changes = append(changes, change)
+			continue
+		}
+		if current.LinkURL != b.LinkURL {
+			change.Changes = append(change.Changes, "link_url")
+		}
+		if current.ImageURL != b.ImageURL {
+			change.Changes = append(change.Changes, "image_url")
+		}
+		if len(change.Changes) > 0 {
+			change.Action, change.LiveID = actionUpdate, current.ID
+			changes = append(changes, change)
+		}
+	}
+
+	if element.CleanUnmanagedBadges {
+		for _, b := range live {
+			if !desiredNames[b.Name] {
+				changes = append(changes, badgeChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: badgeKind, Target: target, Name: b.Name},
+					LiveID:        b.ID,
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+func manageBadges(element config.GitlabElement) bool {
+	return len(element.Badges) > 0 || element.CleanUnmanagedBadges
+}
+
+func applyBadges(fields logger.Fields, owner badgeOwner, element config.GitlabElement, client *gitlab.Client) error {
+	if !manageBadges(element) {
+		return nil
+	}
+	changes, err := badgeChanges(owner, element, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		opt := badgeRequest{
+			Name:     gitlab.String(change.Badge.Name),
+			LinkURL:  gitlab.String(change.Badge.LinkURL),
+			ImageURL: gitlab.String(change.Badge.ImageURL),
+		}
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = doRequest(client, http.MethodPost, owner.path, opt)
+		case actionUpdate:
+			err = doRequest(client, http.MethodPut, fmt.Sprintf("%s/%d", owner.path, change.LiveID), opt)
+		case actionDelete:
+			err = doRequest(client, http.MethodDelete, fmt.Sprintf("%s/%d", owner.path, change.LiveID), nil)
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":  err,
+				"Action": change.Action,
+				"Badge":  change.Name,
+			}).Warning("Error ocured while changing badge")
+		}
+	}
+	return nil
+}
+
+func planBadges(owner badgeOwner, element config.GitlabElement) ([]plannedChange, error) {
+	if !manageBadges(element) {
+		return nil, nil
+	}
+	changes, err := badgeChanges(owner, element, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importBadges(owner badgeOwner, element *config.GitlabElement) error {
+	badges, err := listBadges(owner, gitlabClient)
+	if err != nil {
+		return err
+	}
+	for _, b := range badges {
+		element.Badges = append(element.Badges, config.Badge{Name: b.Name, LinkURL: b.LinkURL, ImageURL: b.ImageURL})
+	}
+	element.CleanUnmanagedBadges = len(badges) > 0
+	return nil
+}
+
+func ManageProjectBadges(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	return applyBadges(logger.Fields{"Project": elementPath(project)}, projectBadges(projectId), project, client)
+}
+
+func ManageGroupBadges(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	return applyBadges(logger.Fields{"Group": elementPath(group)}, groupBadges(groupID), group, client)
+}
+
+func planProjectBadges(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	return planBadges(projectBadges(projectId), project)
+}
+
+func planGroupBadges(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	return planBadges(groupBadges(groupID), group)
+}
+
+func importProjectBadges(project *config.GitlabElement, projectId int) error {
+	return importBadges(projectBadges(projectId), project)
+}
+
+func importGroupBadges(group *config.GitlabElement, groupID int) error {
+	return importBadges(groupBadges(groupID), group)
+}
+
+// badgeRules reports badges which cannot be applied.
+func badgeRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	seen := make(map[string]bool, len(element.Badges))
+	for _, b := range element.Badges {
+		field := "badges." + b.Name
+		if seen[b.Name] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate badge", Fatal: true})
+		}
+		seen[b.Name] = true
+		for _, problem := range config.CheckBadge(b) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	containerPolicyKind  = "container_expiration_policy"
+	registrySettingsKind = "registry_settings"
+)
+
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// registryDefaults returns the registry defaults the groups of the YAML give
+// to projects in namespace, the nearest group winning field by field. owner
+// is the nearest group holding defaults, it applies them to the projects
+// missing in the YAML.
+func registryDefaults(namespace string) (owner string, policy *config.ContainerPolicy, settings *config.RegistrySettings) {
+	byPath := make(map[string]config.GitlabElement, len(groups))
+	for _, g := range groups {
+		if g.State != "absent" {
+			byPath[elementPath(g)] = g
+		}
+	}
+	for path := namespace; path != ""; path = parentPath(path) {
+		g, ok := byPath[path]
+		if !ok || (g.ContainerPolicy == nil && g.RegistrySettings == nil) {
+			continue
+		}
+		if owner == "" {
+			owner = path
+		}
+		policy = policy.Inherit(g.ContainerPolicy)
+		settings = settings.Inherit(g.RegistrySettings)
+	}
+	return owner, policy, settings
+}
+
+// effectiveRegistry returns the registry settings of the project over the
+// defaults of its groups.
+func effectiveRegistry(project config.GitlabElement) (*config.ContainerPolicy, *config.RegistrySettings) {
+	_, policy, settings := registryDefaults(project.Namespace)
+	return project.ContainerPolicy.Inherit(policy), project.RegistrySettings.Inherit(settings)
+}
+
+// registryOpts adds the managed registry settings to opt.
+func registryOpts(opt *gitlab.EditProjectOptions, policy *config.ContainerPolicy, settings *config.RegistrySettings) {
+	if policy != nil {
+		opt.ContainerExpirationPolicyAttributes = &gitlab.ContainerExpirationPolicyAttributes{
+			Enabled:         policy.Enabled,
+			Cadence:         optionalString(policy.Cadence),
+			KeepN:           policy.KeepN,
+			OlderThan:       optionalString(policy.OlderThan),
+			NameRegexDelete: optionalString(policy.NameRegexDelete),
+			NameRegexKeep:   optionalString(policy.NameRegexKeep),
+		}
+	}
+	if settings != nil {
+		opt.PackagesEnabled = settings.PackagesEnabled
+		if settings.ContainerRegistryAccessLevel != "" {
+			opt.ContainerRegistryAccessLevel = gitlab.AccessControl(gitlab.AccessControlValue(settings.ContainerRegistryAccessLevel))
+		}
+	}
+}
+
+// registryChanges compares the managed registry settings with the live
+// project. Fields left out are not compared.
+func registryChanges(target string, live *gitlab.Project, policy *config.ContainerPolicy, settings *config.RegistrySettings) []plannedChange {
+	var changes []plannedChange
+	if policy != nil {
+		current := live.ContainerExpirationPolicy
+		if current == nil {
+			current = &gitlab.ContainerExpirationPolicy{}
+		}
+		if current.NameRegexDelete == "" {
+			current.NameRegexDelete = current.NameRegex
+		}
+		change := plannedChange{Action: actionUpdate, Kind: containerPolicyKind, Target: target}
+		if policy.Enabled != nil && *policy.Enabled != current.Enabled {
+			change.Changes = append(change.Changes, "enabled")
+		}
+		if policy.Cadence != "" && policy.Cadence != current.Cadence {
+			change.Changes = append(change.Changes, "cadence")
+		}
+		if policy.KeepN != nil && *policy.KeepN != current.KeepN {
+			change.Changes = append(change.Changes, "keep_n")
+		}
+		if policy.OlderThan != "" && policy.OlderThan != current.OlderThan {
+			change.Changes = append(change.Changes, "older_than")
+		}
+		if policy.NameRegexDelete != "" && policy.NameRegexDelete != current.NameRegexDelete {
+			change.Changes = append(change.Changes, "name_regex_delete")
+		}
+		if policy.NameRegexKeep != "" && policy.NameRegexKeep != current.NameRegexKeep {
+			change.Changes = append(change.Changes, "name_regex_keep")
+		}
+		if len(change.Changes) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	if settings != nil {
+		change := plannedChange{Action: actionUpdate, Kind: registrySettingsKind, Target: target}
+		if settings.PackagesEnabled != nil && *settings.PackagesEnabled != live.PackagesEnabled {
+			change.Changes = append(change.Changes, "packages_enabled")
+		}
+		if settings.ContainerRegistryAccessLevel != "" && settings.ContainerRegistryAccessLevel != string(live.ContainerRegistryAccessLevel) {
+			change.Changes = append(change.Changes, "container_registry_access_level")
+		}
+		if len(change.Changes) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func planProjectRegistry(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	policy, settings := effectiveRegistry(project)
+	if policy == nil && settings == nil {
+		return nil, nil
+	}
+	live, _, err := gitlabClient.Projects.GetProject(projectId, nil)
+	if err != nil {
+		return nil, err
+	}
+	return registryChanges(elementPath(project), live, policy, settings), nil
+}
+
+func importRegistrySettings(project *config.GitlabElement, projectId int) error {
+	live, _, err := gitlabClient.Projects.GetProject(projectId, nil)
+	if err != nil {
+		return err
+	}
+	if p := live.ContainerExpirationPolicy; p != nil {
+		project.ContainerPolicy = &config.ContainerPolicy{
+			Enabled:         gitlab.Bool(p.Enabled),
+			Cadence:         p.Cadence,
+			KeepN:           gitlab.Int(p.KeepN),
+			OlderThan:       p.OlderThan,
+			NameRegexDelete: p.NameRegexDelete,
+			NameRegexKeep:   p.NameRegexKeep,
+		}
+	}
+	project.RegistrySettings = &config.RegistrySettings{
+		PackagesEnabled:              gitlab.Bool(live.PackagesEnabled),
+		ContainerRegistryAccessLevel: string(live.ContainerRegistryAccessLevel),
+	}
+	return nil
+}
+
+func manageRegistryDefaults(group config.GitlabElement) bool {
+	return group.ContainerPolicy != nil || group.RegistrySettings != nil
+}
+
+// inheritingProjects returns the live projects under the group which take
+// their registry settings from it: projects missing in the YAML, whose
+// nearest group with registry defaults is this one.
+func inheritingProjects(groupID int, group config.GitlabElement, client *gitlab.Client) ([]*gitlab.Project, error) {
+	declared := make(map[string]bool, len(projects))
+	for _, p := range projects {
+		declared[elementPath(p)] = true
+	}
+
+	var inheriting []*gitlab.Project
+	opts := &gitlab.ListGroupProjectsOptions{
+		ListOptions:      gitlab.ListOptions{PerPage: 100},
+		IncludeSubGroups: gitlab.Bool(true),
+		Archived:         gitlab.Bool(false),
+	}
+	for {
+		page, resp, err := client.Groups.ListGroupProjects(groupID, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page {
+			if declared[p.PathWithNamespace] {
+				continue
+			}
+			if owner, _, _ := registryDefaults(p.Namespace.FullPath); owner == elementPath(group) {
+				inheriting = append(inheriting, p)
+			}
+		}
+		if resp.NextPage == 0 {
+			return inheriting, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// ManageGroupRegistryDefaults applies the registry defaults of the group to
+// the projects under it which are missing in the YAML. Projects of the YAML
+// take the defaults with their own settings.
+func ManageGroupRegistryDefaults(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	if !manageRegistryDefaults(group) {
+		return nil
+	}
+	inheriting, err := inheritingProjects(groupID, group, client)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range inheriting {
+		_, policy, settings := registryDefaults(p.Namespace.FullPath)
+		if len(registryChanges(p.PathWithNamespace, p, policy, settings)) == 0 {
+			continue
+		}
+		opt := &gitlab.EditProjectOptions{}
+		registryOpts(opt, policy, settings)
+		if _, _, err := client.Projects.EditProject(p.ID, opt); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Group":   elementPath(group),
+				"Project": p.PathWithNamespace,
+			}).Warning("Error ocured while changing registry settings")
+		}
+	}
+	return nil
+}
+
+func planGroupRegistryDefaults(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	if !manageRegistryDefaults(group) {
+		return nil, nil
+	}
+	inheriting, err := inheritingProjects(groupID, group, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	var changes []plannedChange
+	for _, p := range inheriting {
+		_, policy, settings := registryDefaults(p.Namespace.FullPath)
+		changes = append(changes, registryChanges(p.PathWithNamespace, p, policy, settings)...)
+	}
+	return changes, nil
+}
+
+// registryRules reports registry settings which cannot be applied. On groups
+// they are defaults of the projects under the group.
+func registryRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	if p := element.ContainerPolicy; p != nil {
+		for _, problem := range config.CheckContainerPolicy(*p) {
+			issues = append(issues, validationIssue{Target: target, Field: "container_expiration_policy", Message: problem, Fatal: true})
+		}
+	}
+	if s := element.RegistrySettings; s != nil {
+		for _, problem := range config.CheckRegistrySettings(*s) {
+			issues = append(issues, validationIssue{Target: target, Field: "registry_settings", Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"fmt"
+	"sheeva/config"
+	"strings"
+	"sync"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const deployKeyKind = "deploy_key"
+
+// sharedDeployKey finds the key a project references by title on the
+// closest group above it.
+func sharedDeployKey(project config.GitlabElement, title string) (config.DeployKey, bool) {
+	var found config.DeployKey
+	var depth int
+	for _, g := range groups {
+		path := elementPath(g)
+		if project.Namespace != path && !strings.HasPrefix(project.Namespace, path+"/") {
+			continue
+		}
+		for _, k := range g.DeployKeys {
+			if k.Title == title && len(path) > depth {
+				found, depth = k, len(path)
+			}
+		}
+	}
+	return found, depth > 0
+}
+
+// desiredDeployKey completes a deploy key of the project with the public key
+// of the group it is shared from.
+func desiredDeployKey(project config.GitlabElement, key config.DeployKey) (config.DeployKey, error) {
+	if key.HasKey() {
+		return key, nil
+	}
+	shared, ok := sharedDeployKey(project, key.Title)
+	if !ok || !shared.HasKey() {
+		return key, fmt.Errorf("deploy key '%s' has no key and no group above the project declares it", key.Title)
+	}
+	key.Key, key.KeyFile = shared.Key, shared.KeyFile
+	return key, nil
+}
+
+var (
+	deployKeyIDs     = map[string]int{}
+	deployKeyIDsMu   sync.Mutex
+	instanceKeysOnce sync.Once
+)
+
+// rememberDeployKey records the ID of a key seen in a project, so other
+// projects enable the same key instead of uploading a duplicate.
+func rememberDeployKey(key string, id int) {
+	deployKeyIDsMu.Lock()
+	defer deployKeyIDsMu.Unlock()
+	deployKeyIDs[config.NormalizeKey(key)] = id
+}
+
+// knownDeployKey returns the ID of an existing key. Keys of projects outside
+// the run are only found with an administrator token.
+func knownDeployKey(client *gitlab.Client, key string) (int, bool) {
+	instanceKeysOnce.Do(func() {
+		opts := &gitlab.ListInstanceDeployKeysOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+		for {
+			keys, resp, err := client.DeployKeys.ListAllDeployKeys(opts)
+			if err != nil {
+				logger.WithFields(logger.Fields{
+					"Error": err,
+				}).Debug("Instance deploy keys are not available")
+				return
+			}
+			for _, k := range keys {
+				rememberDeployKey(k.Key, k.ID)
+			}
+			if resp.NextPage == 0 {
+				return
+			}
+			opts.Page = resp.NextPage
+		}
+	})
+
+	deployKeyIDsMu.Lock()
+	defer deployKeyIDsMu.Unlock()
+	id, ok := deployKeyIDs[config.NormalizeKey(key)]
+	return id, ok
+}
+
+func listDeployKeys(projectId int, client *gitlab.Client) ([]*gitlab.ProjectDeployKey, error) {
+	var keys []*gitlab.ProjectDeployKey
+	opts := &gitlab.ListProjectDeployKeysOptions{PerPage: 100}
+	for {
+		page, resp, err := client.DeployKeys.ListProjectDeployKeys(projectId, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range page {
+			rememberDeployKey(k.Key, k.ID)
+		}
+		keys = append(keys, page...)
+		if resp.NextPage == 0 {
+			return keys, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// deployKeyChange is a planned change together with the desired key and
+// the ID of the live one.
+type deployKeyChange struct {
+	plannedChange
+	Title   string
+	Key     string
+	CanPush bool
+	LiveID  int
+}
+
+// deployKeyChanges compares the deploy keys of the project with the live
+// ones by title. A key with another public key is replaced.
+func deployKeyChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]deployKeyChange, error) {
+	target := elementPath(project)
+	live, err := listDeployKeys(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	liveByTitle := make(map[string]*gitlab.ProjectDeployKey, len(live))
+	for _, k := range live {
+		liveByTitle[k.Title] = k
+	}
+
+	var changes []deployKeyChange
+	desiredTitles := make(map[string]bool, len(project.DeployKeys))
+	for _, k := range project.DeployKeys {
+		desiredTitles[k.Title] = true
+		desired, err := desiredDeployKey(project, k)
+		var key string
+		if err == nil {
+			key, err = desired.PublicKey()
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": target,
+				"Key":     k.Title,
+			}).Error("Error while resolving deploy key")
+			continue
+		}
+
+		change := deployKeyChange{
+			plannedChange: plannedChange{Kind: deployKeyKind, Target: target, Name: k.Title},
+			Title:         k.Title,
+			Key:           key,
+			CanPush:       k.CanPush,
+		}
+		current, ok := liveByTitle[k.Title]
+		switch {
+		case !ok:
+			change.Action = actionCreate
+		case config.NormalizeKey(current.Key) != config.NormalizeKey(key):
+			change.Action, change.Changes, change.LiveID = actionReplace, []string{"key"}, current.ID
+		case current.CanPush != k.CanPush:
+			change.Action, change.Changes, change.LiveID = actionUpdate, []string{"can_push"}, current.ID
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	if project.CleanUnmanagedKeys {
+		for _, k := range live {
+			if !desiredTitles[k.Title] {
+				changes = append(changes, deployKeyChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: deployKeyKind, Target: target, Name: k.Title},
+					LiveID:        k.ID,
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+func manageDeployKeys(project config.GitlabElement) bool {
+	return len(project.DeployKeys) > 0 || project.CleanUnmanagedKeys
+}
+
+func ManageDeployKeys(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if !manageDeployKeys(project) {
+		return nil
+	}
+	changes, err := deployKeyChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = AddDeployKey(projectId, change, client)
+		case actionUpdate:
+			_, _, err = client.DeployKeys.UpdateDeployKey(projectId, change.LiveID, &gitlab.UpdateDeployKeyOptions{CanPush: gitlab.Bool(change.CanPush)})
+		case actionReplace:
+			if _, err = client.DeployKeys.DeleteDeployKey(projectId, change.LiveID); err == nil {
+				err = AddDeployKey(projectId, change, client)
+			}
+		case actionDelete:
+			_, err = client.DeployKeys.DeleteDeployKey(projectId, change.LiveID)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": elementPath(project),
+				"Action":  change.Action,
+				"Key":     change.Name,
+			}).Warning("Error ocured while changing deploy key")
+		}
+	}
+	return nil
+}
+
+// AddDeployKey enables the key when it already exists in GitLab, otherwise
+// uploads it. Enabled keys keep their title and start without push access.
+func AddDeployKey(projectId int, change deployKeyChange, client *gitlab.Client) error {
+	if id, ok := knownDeployKey(client, change.Key); ok {
+		if _, _, err := client.DeployKeys.EnableDeployKey(projectId, id); err != nil {
+			return err
+		}
+		_, _, err := client.DeployKeys.UpdateDeployKey(projectId, id, &gitlab.UpdateDeployKeyOptions{
+			Title:   gitlab.String(change.Title),
+			CanPush: gitlab.Bool(change.CanPush),
+		})
+		return err
+	}
+
+	key, _, err := client.DeployKeys.AddDeployKey(projectId, &gitlab.AddDeployKeyOptions{
+		Title:   gitlab.String(change.Title),
+		Key:     gitlab.String(change.Key),
+		CanPush: gitlab.Bool(change.CanPush),
+	})
+	if err != nil {
+		return err
+	}
+	rememberDeployKey(key.Key, key.ID)
+	return nil
+}
+
+func planDeployKeys(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if !manageDeployKeys(project) {
+		return nil, nil
+	}
+	changes, err := deployKeyChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importDeployKeys(project *config.GitlabElement, projectId int) error {
+	keys, err := listDeployKeys(projectId, gitlabClient)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		project.DeployKeys = append(project.DeployKeys, config.DeployKey{Title: k.Title, Key: k.Key, CanPush: k.CanPush})
+	}
+	project.CleanUnmanagedKeys = len(keys) > 0
+	return nil
+}
+
+// deployKeyRules reports deploy keys which cannot be applied. Keys of groups
+// must carry the public key, keys of projects may take it from a group.
+func deployKeyRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	seen := make(map[string]bool, len(element.DeployKeys))
+	for _, k := range element.DeployKeys {
+		field := "deploy_keys." + k.Title
+		if seen[k.Title] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate deploy key", Fatal: true})
+		}
+		seen[k.Title] = true
+		for _, problem := range config.CheckDeployKey(k) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+
+		switch {
+		case kind == groupKind && !k.HasKey():
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Deploy keys of groups need key or key_file", Fatal: true})
+		case kind == projectKind:
+			if _, err := desiredDeployKey(element, k); err != nil {
+				issues = append(issues, validationIssue{Target: target, Field: field, Message: err.Error(), Fatal: true})
+			}
+		}
+	}
+	return issues
+}
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const environmentKind = "environment"
+
+func listEnvironments(projectId int, client *gitlab.Client) ([]*gitlab.Environment, error) {
+	var environments []*gitlab.Environment
+	opts := &gitlab.ListEnvironmentsOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := client.Environments.ListEnvironments(projectId, opts)
+		if err != nil {
+			return nil, err
+		}
+		environments = append(environments, page...)
+		if resp.NextPage == 0 {
+			return environments, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// environmentChange is a planned change together with the desired
+// environment and the ID of the live one.
+type environmentChange struct {
+	plannedChange
+	Environment config.Environment
+	LiveID      int
+}
+
+// environmentChanges compares the environments of the project with the live
+// ones by name. Environments are never deleted, they hold the deployment
+// history. A tier left out in the YAML is not managed.
+func environmentChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]environmentChange, error) {
+	target := elementPath(project)
+	live, err := listEnvironments(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	liveByName := make(map[string]*gitlab.Environment, len(live))
+	for _, e := range live {
+		liveByName[e.Name] = e
+	}
+
+	var changes []environmentChange
+	for _, e := range project.Environments {
+		change := environmentChange{
+			plannedChange: plannedChange{Kind: environmentKind, Target: target, Name: e.Name},
+			Environment:   e,
+		}
+		current, ok := liveByName[e.Name]
+		if !ok {
+			change.Action = actionCreate
+			changes = append(changes, change)
+			continue
+		}
+		if e.ExternalURL != current.ExternalURL {
+			change.Changes = append(change.Changes, "external_url")
+		}
+		if e.Tier != "" && e.Tier != current.Tier {
+			change.Changes = append(change.Changes, "tier")
+		}
+		if len(change.Changes) > 0 {
+			change.Action, change.LiveID = actionUpdate, current.ID
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return gitlab.String(s)
+}
+
+func ManageEnvironments(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if len(project.Environments) == 0 {
+		return nil
+	}
+	changes, err := environmentChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			_, _, err = client.Environments.CreateEnvironment(projectId, &gitlab.CreateEnvironmentOptions{
+				Name:        gitlab.String(change.Environment.Name),
+				ExternalURL: optionalString(change.Environment.ExternalURL),
+				Tier:        optionalString(change.Environment.Tier),
+			})
+		case actionUpdate:
+			_, _, err = client.Environments.EditEnvironment(projectId, change.LiveID, &gitlab.EditEnvironmentOptions{
+				ExternalURL: gitlab.String(change.Environment.ExternalURL),
+				Tier:        optionalString(change.Environment.Tier),
+			})
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":       err,
+				"Project":     elementPath(project),
+				"Action":      change.Action,
+				"Environment": change.Name,
+			}).Warning("Error ocured while changing environment")
+		}
+	}
+	return nil
+}
+
+func planEnvironments(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if len(project.Environments) == 0 {
+		return nil, nil
+	}
+	changes, err := environmentChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importEnvironments(project *config.GitlabElement, projectId int) error {
+	environments, err := listEnvironments(projectId, gitlabClient)
+	if err != nil {
+		return err
+	}
+	for _, e := range environments {
+		project.Environments = append(project.Environments, config.Environment{Name: e.Name, ExternalURL: e.ExternalURL, Tier: e.Tier})
+	}
+	return nil
+}
+
+// environmentRules reports environments and environment protections which
+// cannot be applied. Environments belong to projects, groups only protect
+// deployment tiers.
+func environmentRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	if kind != projectKind && len(element.Environments) > 0 {
+		issues = append(issues, validationIssue{Target: target, Field: "environments", Message: "Environments are only supported on projects", Fatal: true})
+	}
+
+	seen := make(map[string]bool, len(element.Environments))
+	for _, e := range element.Environments {
+		field := "environments." + e.Name
+		if seen[e.Name] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate environment", Fatal: true})
+		}
+		seen[e.Name] = true
+		for _, problem := range config.CheckEnvironment(e) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+
+	seen = make(map[string]bool, len(element.ProtectedEnvironments))
+	for _, e := range element.ProtectedEnvironments {
+		field := "protected_environments." + e.Name
+		if seen[e.Name] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate protected environment", Fatal: true})
+		}
+		seen[e.Name] = true
+		for _, problem := range config.CheckProtectedEnv(e, kind == groupKind) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
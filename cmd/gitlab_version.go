@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"os"
+	"sheeva/config"
+	"sync"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+var (
+	remoteVersionOnce sync.Once
+	remoteVersion     config.GitlabVersion
+)
+
+// localGitlabVersion reads SHEEVA_GITLAB_VERSION. The zero version means
+// unknown, in which case the rules of the newest GitLab apply.
+func localGitlabVersion() config.GitlabVersion {
+	v := os.Getenv("SHEEVA_GITLAB_VERSION")
+	if v == "" {
+		return config.GitlabVersion{}
+	}
+	version, err := config.ParseGitlabVersion(v)
+	if err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+		}).Warning("Invalid SHEEVA_GITLAB_VERSION")
+	}
+	return version
+}
+
+// gitlabVersion asks the instance for its version once per run, unless
+// SHEEVA_GITLAB_VERSION overrides it.
+func gitlabVersion() config.GitlabVersion {
+	remoteVersionOnce.Do(func() {
+		if remoteVersion = localGitlabVersion(); remoteVersion != (config.GitlabVersion{}) {
+			return
+		}
+		v, _, err := gitlabClient.Version.GetVersion()
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error": err,
+			}).Warning("Error while receiving GitLab version")
+			return
+		}
+		if remoteVersion, err = config.ParseGitlabVersion(v.Version); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error": err,
+			}).Warning("Error while parsing GitLab version")
+		}
+	})
+	return remoteVersion
+}
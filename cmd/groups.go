@@ -48,6 +48,72 @@ func manageGroup(group config.GitlabElement, client *gitlab.Client) error {
 	}
 
 	ManageVariables(groupID, group, client)
+	if err := ManageGroupMembers(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group members")
+	}
+	if err := ManageGroupSharedGroups(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group shared groups")
+	}
+	if err := ManageGroupLinks(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group links")
+	}
+	if err := ManageGroupApprovals(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group approvals")
+	}
+	if err := ManageGroupPushRules(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group push rules")
+	}
+	if err := ManageGroupTokens(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group tokens")
+	}
+	if err := ManageGroupLabels(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group labels")
+	}
+	if err := ManageGroupMilestones(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group milestones")
+	}
+	if err := ManageGroupBadges(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group badges")
+	}
+	if err := ManageGroupProtectedEnvironments(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group protected environments")
+	}
+	if err := ManageGroupRegistryDefaults(groupID, group, client); err != nil {
+		logger.WithFields(logger.Fields{
+			"Error": err,
+			"Group": groupFullPath,
+		}).Error("Error while managing group registry defaults")
+	}
 	if err != nil {
 		logger.WithFields(logger.Fields{
 			"Error": err,
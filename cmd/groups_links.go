@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	ldapLinkKind = "ldap_link"
+	samlLinkKind = "saml_link"
+)
+
+// groupLink is an LDAP or SAML group link, identified by its provider and cn
+// or filter, or by the SAML group name. A rejected link is declared but
+// cannot be applied, it is neither changed nor removed.
+type groupLink struct {
+	Kind        string
+	ID          string
+	AccessLevel gitlab.AccessLevelValue
+	LDAP        config.LDAPLink
+	SAML        string
+	Rejected    bool
+}
+
+func ldapLinkID(provider, cn, filter string) string {
+	if cn != "" {
+		return provider + ":" + cn
+	}
+	return provider + ":" + filter
+}
+
+// groupLinkChange is a planned change together with the link it applies to.
+type groupLinkChange struct {
+	plannedChange
+	Link groupLink
+}
+
+func desiredGroupLinks(fields logger.Fields, group config.GitlabElement) []groupLink {
+	var links []groupLink
+	check := func(link groupLink, problems []string) groupLink {
+		if len(problems) > 0 {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Problems": strings.Join(problems, "; "),
+				"Kind":     link.Kind,
+				"Link":     link.ID,
+			}).Error("Group link rejected by local validation")
+			link.Rejected = true
+		}
+		return link
+	}
+
+	for _, l := range group.LDAPLinks {
+		level, _ := config.ParseAccessLevel(l.AccessLevel)
+		link := groupLink{Kind: ldapLinkKind, ID: ldapLinkID(l.Provider, l.CN, l.Filter), AccessLevel: level, LDAP: l}
+		links = append(links, check(link, config.CheckLDAPLink(l)))
+	}
+	for _, l := range group.SAMLLinks {
+		level, _ := config.ParseAccessLevel(l.AccessLevel)
+		link := groupLink{Kind: samlLinkKind, ID: l.Name, AccessLevel: level, SAML: l.Name}
+		links = append(links, check(link, config.CheckSAMLLink(l)))
+	}
+	return links
+}
+
+// listGroupLinks returns the live links of the kinds the group manages, so
+// groups without LDAP or SAML links do not need the features licensed.
+func listGroupLinks(groupID int, group config.GitlabElement, client *gitlab.Client) ([]groupLink, error) {
+	var links []groupLink
+	if len(group.LDAPLinks) > 0 || group.CleanUnmanagedLDAP {
+		ldap, _, err := client.Groups.ListGroupLDAPLinks(groupID)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range ldap {
+			links = append(links, groupLink{
+				Kind:        ldapLinkKind,
+				ID:          ldapLinkID(l.Provider, l.CN, l.Filter),
+				AccessLevel: l.GroupAccess,
+				LDAP:        config.LDAPLink{Provider: l.Provider, CN: l.CN, Filter: l.Filter},
+			})
+		}
+	}
+	if len(group.SAMLLinks) > 0 || group.CleanUnmanagedSAML {
+		saml, _, err := client.Groups.ListGroupSAMLLinks(groupID)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range saml {
+			links = append(links, groupLink{Kind: samlLinkKind, ID: l.Name, AccessLevel: l.AccessLevel, SAML: l.Name})
+		}
+	}
+	return links, nil
+}
+
+// diffGroupLinks compares desired links with the live ones. Links cannot be
+// edited, so links with another access level are replaced.
+func diffGroupLinks(target string, group config.GitlabElement, desired, live []groupLink) []groupLinkChange {
+	key := func(l groupLink) string { return l.Kind + "/" + l.ID }
+	liveByKey := make(map[string]groupLink, len(live))
+	for _, l := range live {
+		liveByKey[key(l)] = l
+	}
+
+	var changes []groupLinkChange
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, l := range desired {
+		desiredKeys[key(l)] = true
+		current, ok := liveByKey[key(l)]
+		switch {
+		case l.Rejected:
+		case !ok:
+			changes = append(changes, groupLinkChange{
+				plannedChange: plannedChange{Action: actionCreate, Kind: l.Kind, Target: target, Name: l.ID},
+				Link:          l,
+			})
+		case current.AccessLevel != l.AccessLevel:
+			changes = append(changes, groupLinkChange{
+				plannedChange: plannedChange{Action: actionReplace, Kind: l.Kind, Target: target, Name: l.ID, Changes: []string{"access_level"}},
+				Link:          l,
+			})
+		}
+	}
+
+	clean := map[string]bool{
+		ldapLinkKind: group.CleanUnmanagedLDAP,
+		samlLinkKind: group.CleanUnmanagedSAML,
+	}
+	for _, l := range live {
+		if clean[l.Kind] && !desiredKeys[key(l)] {
+			changes = append(changes, groupLinkChange{
+				plannedChange: plannedChange{Action: actionDelete, Kind: l.Kind, Target: target, Name: l.ID},
+				Link:          l,
+			})
+		}
+	}
+	return changes
+}
+
+func manageGroupLinks(group config.GitlabElement) bool {
+	return len(group.LDAPLinks) > 0 || group.CleanUnmanagedLDAP || len(group.SAMLLinks) > 0 || group.CleanUnmanagedSAML
+}
+
+func groupLinkChanges(groupID int, group config.GitlabElement, client *gitlab.Client) ([]groupLinkChange, error) {
+	fields := logger.Fields{"Group": elementPath(group)}
+	live, err := listGroupLinks(groupID, group, client)
+	if err != nil {
+		return nil, err
+	}
+	return diffGroupLinks(elementPath(group), group, desiredGroupLinks(fields, group), live), nil
+}
+
+func ManageGroupLinks(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	if !manageGroupLinks(group) {
+		return nil
+	}
+	changes, err := groupLinkChanges(groupID, group, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = AddGroupLink(groupID, change.Link, client)
+		case actionReplace:
+			if err = RemoveGroupLink(groupID, change.Link, client); err == nil {
+				err = AddGroupLink(groupID, change.Link, client)
+			}
+		case actionDelete:
+			err = RemoveGroupLink(groupID, change.Link, client)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":  err,
+				"Group":  elementPath(group),
+				"Action": change.Action,
+				"Kind":   change.Kind,
+				"Link":   change.Name,
+			}).Warning("Error ocured while changing group link")
+		}
+	}
+	return nil
+}
+
+func AddGroupLink(groupID int, link groupLink, client *gitlab.Client) error {
+	if link.Kind == samlLinkKind {
+		_, _, err := client.Groups.AddGroupSAMLLink(groupID, &gitlab.AddGroupSAMLLinkOptions{
+			SAMLGroupName: gitlab.String(link.SAML),
+			AccessLevel:   gitlab.AccessLevel(link.AccessLevel),
+		})
+		return err
+	}
+	opt := &gitlab.AddGroupLDAPLinkOptions{
+		GroupAccess: gitlab.AccessLevel(link.AccessLevel),
+		Provider:    gitlab.String(link.LDAP.Provider),
+	}
+	if link.LDAP.CN != "" {
+		opt.CN = gitlab.String(link.LDAP.CN)
+	} else {
+		opt.Filter = gitlab.String(link.LDAP.Filter)
+	}
+	_, _, err := client.Groups.AddGroupLDAPLink(groupID, opt)
+	return err
+}
+
+func RemoveGroupLink(groupID int, link groupLink, client *gitlab.Client) error {
+	if link.Kind == samlLinkKind {
+		_, err := client.Groups.DeleteGroupSAMLLink(groupID, link.SAML)
+		return err
+	}
+	opt := &gitlab.DeleteGroupLDAPLinkWithCNOrFilterOptions{
+		Provider: gitlab.String(link.LDAP.Provider),
+	}
+	if link.LDAP.CN != "" {
+		opt.CN = gitlab.String(link.LDAP.CN)
+	} else {
+		opt.Filter = gitlab.String(link.LDAP.Filter)
+	}
+	_, err := client.Groups.DeleteGroupLDAPLinkWithCNOrFilter(groupID, opt)
+	return err
+}
+
+func planGroupLinks(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	if !manageGroupLinks(group) {
+		return nil, nil
+	}
+	changes, err := groupLinkChanges(groupID, group, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+// groupLinkRules reports LDAP and SAML links which cannot be applied. Links
+// exist only on groups.
+func groupLinkRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+
+	if kind != groupKind {
+		if len(element.LDAPLinks) > 0 || len(element.SAMLLinks) > 0 {
+			issues = append(issues, validationIssue{Target: target, Field: "ldap_links", Message: "LDAP and SAML links are only supported on groups", Fatal: true})
+		}
+		return issues
+	}
+
+	seen := map[string]bool{}
+	check := func(field string, problems []string) {
+		if seen[field] {
+			problems = append(problems, "Duplicate group link")
+		}
+		seen[field] = true
+		for _, problem := range problems {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	for _, l := range element.LDAPLinks {
+		check("ldap_links."+ldapLinkID(l.Provider, l.CN, l.Filter), config.CheckLDAPLink(l))
+	}
+	for _, l := range element.SAMLLinks {
+		check("saml_links."+l.Name, config.CheckSAMLLink(l))
+	}
+	return issues
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func ManageGroupMembers(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	if len(group.Members) == 0 && !group.CleanUnmanagedMembers {
+		return nil
+	}
+	changes, err := groupMemberChanges(groupID, group, client)
+	if err != nil {
+		return err
+	}
+
+	memberClient{
+		add: func(c memberChange) error {
+			_, _, err := client.GroupMembers.AddGroupMember(groupID, &gitlab.AddGroupMemberOptions{
+				UserID:      gitlab.Int(c.UserID),
+				AccessLevel: gitlab.AccessLevel(c.AccessLevel),
+				ExpiresAt:   expiresAt(c.ExpiresAt),
+			})
+			return err
+		},
+		edit: func(c memberChange) error {
+			_, _, err := client.GroupMembers.EditGroupMember(groupID, c.UserID, &gitlab.EditGroupMemberOptions{
+				AccessLevel: gitlab.AccessLevel(c.AccessLevel),
+				ExpiresAt:   gitlab.String(c.ExpiresAt),
+			})
+			return err
+		},
+		remove: func(c memberChange) error {
+			_, err := client.GroupMembers.RemoveGroupMember(groupID, c.UserID, nil)
+			return err
+		},
+	}.apply(logger.Fields{"Group": elementPath(group)}, changes)
+	return nil
+}
+
+func listGroupMembers(groupID int, client *gitlab.Client) ([]liveMember, error) {
+	var members []liveMember
+	opts := &gitlab.ListGroupMembersOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := client.Groups.ListGroupMembers(groupID, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page {
+			members = append(members, liveMember{
+				ID:          m.ID,
+				Username:    m.Username,
+				AccessLevel: m.AccessLevel,
+				ExpiresAt:   isoDate(m.ExpiresAt),
+			})
+		}
+		if resp.NextPage == 0 {
+			return members, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func groupMemberChanges(groupID int, group config.GitlabElement, client *gitlab.Client) ([]memberChange, error) {
+	live, err := listGroupMembers(groupID, client)
+	if err != nil {
+		return nil, err
+	}
+	return diffMembers(client, elementPath(group), true, group.Members, live, group.CleanUnmanagedMembers), nil
+}
+
+func planGroupMembers(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	if len(group.Members) == 0 && !group.CleanUnmanagedMembers {
+		return nil, nil
+	}
+	changes, err := groupMemberChanges(groupID, group, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
 	"sheeva/config"
 
 	logger "github.com/sirupsen/logrus"
@@ -8,47 +11,46 @@ import (
 )
 
 func ManageVariables(groupID int, group config.GitlabElement, client *gitlab.Client) {
-	if group.CleanUnmanagedVars {
-		if err := CleanUnmanagedVariablesGroup(groupID, client); err != nil {
-			logger.WithFields(logger.Fields{
-				"Error": err,
-				"Group": group.Namespace + "/" + group.Name,
-			}).Warning("Error ocured while remove unamanaged variables")
-		}
+	fields := logger.Fields{"Group": group.Namespace + "/" + group.Name}
+	live, err := listGroupVariables(groupID, client)
+	if err != nil {
+		logger.WithFields(fields).WithFields(logger.Fields{
+			"Error": err,
+		}).Warning("Error ocured while listing variables")
+		return
 	}
+	variables, clean := desiredVariables(fields, group, config.CheckVariable)
 
-	variablesFile := group.VariablesFile
-	if variablesFile != "" {
-		fileVariables, err := config.ParseVariableFile(group.VariablesFile)
-		if err != nil {
-			logger.WithFields(logger.Fields{
-				"Error": err,
-				"Group": group.Namespace + "/" + group.Name,
-			}).Error("Error ocured while parsing variable file")
-		}
-		group.Variables = append(group.Variables, fileVariables.Variables...)
-	}
+	variableClient{
+		create: func(v config.Variable) error { return CreateGroupVariable(groupID, v, client) },
+		update: func(v config.Variable) error { return UpdateGroupVariable(groupID, v, client) },
+		remove: func(v config.Variable) error { return RemoveGroupVariable(groupID, v, client) },
+	}.apply(fields, diffVariables(elementPath(group), variables, live, clean))
+}
 
-	for _, variable := range group.Variables {
-		if err := CreateGroupVariable(groupID, variable, client); err != nil {
-			err = UpdateGroupVariable(groupID, variable, client)
-			if err != nil {
-				logger.WithFields(logger.Fields{
-					"Error":    err,
-					"Group":    group.Namespace + "/" + group.Name,
-					"Variable": variable.Key,
-				}).Warning("Error ocured while updating variable")
-			}
-		}
-	}
+type createGroupVariableRequest struct {
+	*gitlab.CreateGroupVariableOptions
+	variableAttributes
+}
+
+// updateGroupVariableRequest carries the environment filter go-gitlab lacks
+// for group variables, without it GitLab updates a random scope of the key.
+type updateGroupVariableRequest struct {
+	*gitlab.UpdateGroupVariableOptions
+	variableAttributes
+	Filter *gitlab.VariableFilter `url:"filter,omitempty" json:"filter,omitempty"`
+}
+
+// removeGroupVariableRequest is sent as query parameters.
+type removeGroupVariableRequest struct {
+	Filter *gitlab.VariableFilter `url:"filter,omitempty" json:"filter,omitempty"`
 }
 
 func CreateGroupVariable(groupID int, variable config.Variable, client *gitlab.Client) error {
-	_, _, err := client.GroupVariables.CreateVariable(groupID, getCreateGroupVariableOptions(variable))
-	if err != nil {
-		return err
-	}
-	return nil
+	return doRequest(client, http.MethodPost, fmt.Sprintf("groups/%d/variables", groupID), createGroupVariableRequest{
+		getCreateGroupVariableOptions(variable),
+		newVariableAttributes(variable, true),
+	})
 }
 
 func getCreateGroupVariableOptions(variable config.Variable) *gitlab.CreateGroupVariableOptions {
@@ -58,17 +60,18 @@ func getCreateGroupVariableOptions(variable config.Variable) *gitlab.CreateGroup
 		VariableType:     gitlab.VariableType(gitlab.VariableTypeValue(variable.VariableType)),
 		Protected:        gitlab.Bool(variable.Protected),
 		Masked:           gitlab.Bool(variable.Masked),
+		Raw:              gitlab.Bool(variable.Raw),
 		EnvironmentScope: gitlab.String(variable.Environment),
 	}
 	return GroupVariableOpts
 }
 
 func UpdateGroupVariable(groupID int, variable config.Variable, client *gitlab.Client) error {
-	_, _, err := client.GroupVariables.UpdateVariable(groupID, variable.Key, getUpdateGroupVariableOptions(variable))
-	if err != nil {
-		return err
-	}
-	return nil
+	return doRequest(client, http.MethodPut, fmt.Sprintf("groups/%d/variables/%s", groupID, url.PathEscape(variable.Key)), updateGroupVariableRequest{
+		getUpdateGroupVariableOptions(variable),
+		newVariableAttributes(variable, false),
+		variableFilter(variable),
+	})
 }
 
 func getUpdateGroupVariableOptions(variable config.Variable) *gitlab.UpdateGroupVariableOptions {
@@ -77,24 +80,14 @@ func getUpdateGroupVariableOptions(variable config.Variable) *gitlab.UpdateGroup
 		VariableType:     gitlab.VariableType(gitlab.VariableTypeValue(variable.VariableType)),
 		Protected:        gitlab.Bool(variable.Protected),
 		Masked:           gitlab.Bool(variable.Masked),
+		Raw:              gitlab.Bool(variable.Raw),
 		EnvironmentScope: gitlab.String(variable.Environment),
 	}
 	return GroupVariableOpts
 }
 
-func CleanUnmanagedVariablesGroup(groupID int, client *gitlab.Client) error {
-	vars, _, err := client.GroupVariables.ListVariables(groupID, &gitlab.ListGroupVariablesOptions{})
-	if err != nil {
-		return err
-	}
-
-	for _, v := range vars {
-		_, err := client.GroupVariables.RemoveVariable(groupID, v.Key)
-		if err != nil {
-			return err
-		}
-
-	}
-
-	return nil
+func RemoveGroupVariable(groupID int, variable config.Variable, client *gitlab.Client) error {
+	return doRequest(client, http.MethodDelete, fmt.Sprintf("groups/%d/variables/%s", groupID, url.PathEscape(variable.Key)), removeGroupVariableRequest{
+		Filter: variableFilter(variable),
+	})
 }
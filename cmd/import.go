@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// importer fills one aspect of element with its live state in GitLab.
+type importer func(element *config.GitlabElement, id int) error
+
+var (
+	groupImporters   = []importer{importGroupVariables, importGroupApprovals, importGroupPushRules, importGroupTokens, importGroupLabels, importGroupMilestones, importGroupBadges, importGroupProtectedEnvironments}
+	projectImporters = []importer{importProjectVariables, importDeployKeys, importProtectedBranches, importProtectedTags, importProjectApprovals, importProjectPushRules, importProjectTokens, importProjectLabels, importProjectMilestones, importProjectBadges, importEnvironments, importProjectProtectedEnvironments, importTriggers, importJobTokenScope, importMirrors, importRegistrySettings}
+)
+
+// Import prints the YAML describing an existing project or group, so it can
+// be put under management as is.
+func Import(fullPath string) error {
+	return importElement(fullPath, os.Stdout)
+}
+
+func importElement(fullPath string, w io.Writer) error {
+	var gac config.GACFile
+
+	if project, _, err := gitlabClient.Projects.GetProject(fullPath, nil); err == nil {
+		element := config.GitlabElement{
+			Name:               project.Path,
+			Namespace:          project.Namespace.FullPath,
+			State:              "present",
+			Description:        project.Description,
+			Visibility:         string(project.Visibility),
+			CleanUnmanagedVars: true,
+			CIConfigPath:       project.CIConfigPath,
+		}
+		if err := runImporters(projectImporters, &element, project.ID); err != nil {
+			return err
+		}
+		gac.Projects = append(gac.Projects, element)
+	} else if group, _, err := gitlabClient.Groups.GetGroup(fullPath, nil); err == nil {
+		namespace := path.Dir(group.FullPath)
+		if namespace == "." {
+			namespace = group.Path
+		}
+		element := config.GitlabElement{
+			Name:               group.Path,
+			Namespace:          namespace,
+			State:              "present",
+			Description:        group.Description,
+			Visibility:         string(group.Visibility),
+			CleanUnmanagedVars: true,
+		}
+		if err := runImporters(groupImporters, &element, group.ID); err != nil {
+			return err
+		}
+		gac.Groups = append(gac.Groups, element)
+	} else {
+		return fmt.Errorf("project or group '%s' not found", fullPath)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(gac); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func runImporters(importers []importer, element *config.GitlabElement, id int) error {
+	for _, i := range importers {
+		if err := i(element, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func importVariables(element *config.GitlabElement, variables []config.Variable) {
+	for _, v := range variables {
+		if v.Hidden {
+			// GitLab does not return the value, point it to a file to fill in
+			name := v.Key
+			if v.Environment != "" && v.Environment != defaultEnvironmentScope {
+				name = config.VariableID(v)
+			}
+			v.ValueFrom = &config.ValueFrom{Provider: "file", Path: path.Join(elementPath(*element), name)}
+			logger.WithFields(logger.Fields{
+				"Target":   elementPath(*element),
+				"Variable": v.Key,
+				"File":     v.ValueFrom.Path,
+			}).Warning("Hidden variable value cannot be imported, put it into the value_from file")
+		}
+		element.Variables = append(element.Variables, v)
+	}
+}
+
+func importProjectVariables(project *config.GitlabElement, projectId int) error {
+	variables, err := listProjectVariables(projectId, gitlabClient)
+	if err != nil {
+		return err
+	}
+	importVariables(project, variables)
+	return nil
+}
+
+func importGroupVariables(group *config.GitlabElement, groupID int) error {
+	variables, err := listGroupVariables(groupID, gitlabClient)
+	if err != nil {
+		return err
+	}
+	importVariables(group, variables)
+	return nil
+}
@@ -10,6 +10,7 @@ var (
 	baseURL, token, rootDir string
 	gitlabClient            *gitlab.Client
 	groups, projects        []config.GitlabElement
+	instance                config.Instance
 )
 
 func init() {
@@ -20,7 +21,7 @@ func init() {
 	}
 
 	gitlabClient = c
-	groups, projects, err = config.ParseYaml(rootDir)
+	groups, projects, instance, err = config.ParseYaml(rootDir)
 	if err != nil {
 		panic(err)
 	}
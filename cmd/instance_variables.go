@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const instanceVariablesPath = "admin/ci/variables"
+
+// instanceElement presents the instance section as an element, so variables
+// are loaded, validated and diffed the same way as for groups and projects.
+func instanceElement() config.GitlabElement {
+	return config.GitlabElement{
+		Name:               instanceKind,
+		Namespace:          instanceKind,
+		CleanUnmanagedVars: instance.CleanUnmanagedVars,
+		VariablesFile:      instance.VariablesFile,
+		Variables:          instance.Variables,
+	}
+}
+
+// ManageInstance applies the instance section. Nothing is done when it is
+// not declared, so non-admin tokens keep working.
+func ManageInstance() error {
+	if instance.IsEmpty() {
+		return nil
+	}
+	return ManageInstanceVariables(gitlabClient)
+}
+
+func ManageInstanceVariables(client *gitlab.Client) error {
+	element := instanceElement()
+	fields := logger.Fields{"Target": instanceKind}
+	live, err := listVariables(client, instanceVariablesPath)
+	if err != nil {
+		return err
+	}
+	variables, clean := desiredVariables(fields, element, config.CheckInstanceVariable)
+
+	variableClient{
+		create: func(v config.Variable) error { return CreateInstanceVariable(v, client) },
+		update: func(v config.Variable) error { return UpdateInstanceVariable(v, client) },
+		remove: func(v config.Variable) error { return RemoveInstanceVariable(v, client) },
+	}.apply(fields, diffVariables(instanceKind, variables, live, clean))
+	return nil
+}
+
+// instanceVariableAttributes holds the attributes go-gitlab does not send for
+// instance variables.
+type instanceVariableAttributes struct {
+	Raw         *bool   `url:"raw,omitempty" json:"raw,omitempty"`
+	Description *string `url:"description,omitempty" json:"description,omitempty"`
+}
+
+func newInstanceVariableAttributes(variable config.Variable) instanceVariableAttributes {
+	attributes := instanceVariableAttributes{Raw: gitlab.Bool(variable.Raw)}
+	if gitlabVersion().AtLeast(16, 2) {
+		attributes.Description = gitlab.String(variable.Description)
+	}
+	return attributes
+}
+
+type createInstanceVariableRequest struct {
+	*gitlab.CreateInstanceVariableOptions
+	instanceVariableAttributes
+}
+
+type updateInstanceVariableRequest struct {
+	*gitlab.UpdateInstanceVariableOptions
+	instanceVariableAttributes
+}
+
+func CreateInstanceVariable(variable config.Variable, client *gitlab.Client) error {
+	return doRequest(client, http.MethodPost, instanceVariablesPath, createInstanceVariableRequest{
+		&gitlab.CreateInstanceVariableOptions{
+			Key:          gitlab.String(variable.Key),
+			Value:        gitlab.String(variable.Value),
+			VariableType: gitlab.VariableType(gitlab.VariableTypeValue(variable.VariableType)),
+			Protected:    gitlab.Bool(variable.Protected),
+			Masked:       gitlab.Bool(variable.Masked),
+		},
+		newInstanceVariableAttributes(variable),
+	})
+}
+
+func UpdateInstanceVariable(variable config.Variable, client *gitlab.Client) error {
+	return doRequest(client, http.MethodPut, fmt.Sprintf("%s/%s", instanceVariablesPath, url.PathEscape(variable.Key)), updateInstanceVariableRequest{
+		&gitlab.UpdateInstanceVariableOptions{
+			Value:        gitlab.String(variable.Value),
+			VariableType: gitlab.VariableType(gitlab.VariableTypeValue(variable.VariableType)),
+			Protected:    gitlab.Bool(variable.Protected),
+			Masked:       gitlab.Bool(variable.Masked),
+		},
+		newInstanceVariableAttributes(variable),
+	})
+}
+
+func RemoveInstanceVariable(variable config.Variable, client *gitlab.Client) error {
+	_, err := client.InstanceVariables.RemoveVariable(variable.Key)
+	return err
+}
+
+func planInstanceVariables() ([]plannedChange, error) {
+	element := instanceElement()
+	fields := logger.Fields{"Target": instanceKind}
+	live, err := listVariables(gitlabClient, instanceVariablesPath)
+	if err != nil {
+		return nil, err
+	}
+	desired, clean := desiredVariables(fields, element, config.CheckInstanceVariable)
+	return planned(diffVariables(instanceKind, desired, live, clean)), nil
+}
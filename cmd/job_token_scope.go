@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sheeva/config"
+	"sort"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	jobTokenScopeKind     = "job_token_scope"
+	jobTokenAllowlistKind = "job_token_allowlist"
+)
+
+// apiJobTokenScope is the job token scope of a project. go-gitlab does not
+// cover the job token scope API.
+type apiJobTokenScope struct {
+	InboundEnabled bool `json:"inbound_enabled"`
+}
+
+type apiAllowlistEntry struct {
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	FullPath          string `json:"full_path"`
+}
+
+// allowlist is the project or group part of the job token allowlist.
+type allowlist struct {
+	kind string
+	path string
+}
+
+func projectAllowlist(projectId int) allowlist {
+	return allowlist{kind: projectKind, path: fmt.Sprintf("projects/%d/job_token_scope/allowlist", projectId)}
+}
+
+func groupAllowlist(projectId int) allowlist {
+	return allowlist{kind: groupKind, path: fmt.Sprintf("projects/%d/job_token_scope/groups_allowlist", projectId)}
+}
+
+// list returns the paths on the allowlist by their IDs.
+func (a allowlist) list(client *gitlab.Client) (map[string]int, error) {
+	entries := map[string]int{}
+	opts := &gitlab.ListOptions{PerPage: 100}
+	for {
+		req, err := client.NewRequest(http.MethodGet, a.path, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []apiAllowlistEntry
+		resp, err := client.Do(req, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			if a.kind == projectKind {
+				entries[e.PathWithNamespace] = e.ID
+			} else {
+				entries[e.FullPath] = e.ID
+			}
+		}
+		if resp.NextPage == 0 {
+			return entries, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+type allowlistRequest struct {
+	TargetProjectID *int `url:"target_project_id,omitempty" json:"target_project_id,omitempty"`
+	TargetGroupID   *int `url:"target_group_id,omitempty" json:"target_group_id,omitempty"`
+}
+
+func (a allowlist) add(path string, client *gitlab.Client) error {
+	var opt allowlistRequest
+	if a.kind == projectKind {
+		id, err := GetProjectId(path, client)
+		if err != nil {
+			return err
+		}
+		opt.TargetProjectID = gitlab.Int(id)
+	} else {
+		id, err := GetGroupID(path, client)
+		if err != nil {
+			return err
+		}
+		opt.TargetGroupID = gitlab.Int(id)
+	}
+	return doRequest(client, http.MethodPost, a.path, opt)
+}
+
+func (a allowlist) remove(id int, client *gitlab.Client) error {
+	return doRequest(client, http.MethodDelete, fmt.Sprintf("%s/%d", a.path, id), nil)
+}
+
+// jobTokenChange is a planned change of the scope setting or of an entry of
+// an allowlist.
+type jobTokenChange struct {
+	plannedChange
+	Allowlist allowlist
+	Enabled   bool
+	LiveID    int
+}
+
+// jobTokenScopeChanges compares the job token scope of the project with the
+// live one. The project itself is always on its allowlist and is ignored.
+// Paths are compared case insensitively, as GitLab does. Entries are added
+// before the scope is enabled, so jobs of allowed projects keep working.
+func jobTokenScopeChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]jobTokenChange, error) {
+	target := elementPath(project)
+	scope := project.JobTokenScope
+
+	var added, enabled, removed []jobTokenChange
+	if scope.Enabled != nil {
+		var live apiJobTokenScope
+		req, err := client.NewRequest(http.MethodGet, fmt.Sprintf("projects/%d/job_token_scope", projectId), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := client.Do(req, &live); err != nil {
+			return nil, err
+		}
+		if live.InboundEnabled != *scope.Enabled {
+			enabled = append(enabled, jobTokenChange{
+				plannedChange: plannedChange{Action: actionUpdate, Kind: jobTokenScopeKind, Target: target, Changes: []string{"enabled"}},
+				Enabled:       *scope.Enabled,
+			})
+		}
+	}
+
+	for _, l := range []struct {
+		allowlist allowlist
+		desired   []string
+	}{
+		{projectAllowlist(projectId), scope.Projects},
+		{groupAllowlist(projectId), scope.Groups},
+	} {
+		live, err := l.allowlist.list(client)
+		// Older instances have no groups allowlist
+		if isUnavailable(err) && l.allowlist.kind == groupKind && len(l.desired) == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		liveByPath := make(map[string]bool, len(live))
+		for path := range live {
+			liveByPath[strings.ToLower(path)] = true
+		}
+		desired := make(map[string]bool, len(l.desired))
+		for _, path := range l.desired {
+			desired[strings.ToLower(path)] = true
+			if !liveByPath[strings.ToLower(path)] {
+				added = append(added, jobTokenChange{
+					plannedChange: plannedChange{Action: actionCreate, Kind: jobTokenAllowlistKind, Target: target, Name: path},
+					Allowlist:     l.allowlist,
+				})
+			}
+		}
+		for _, path := range sortedKeys(live) {
+			if !desired[strings.ToLower(path)] && !strings.EqualFold(path, target) {
+				removed = append(removed, jobTokenChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: jobTokenAllowlistKind, Target: target, Name: path},
+					Allowlist:     l.allowlist,
+					LiveID:        live[path],
+				})
+			}
+		}
+	}
+	return append(append(added, enabled...), removed...), nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type jobTokenScopeRequest struct {
+	Enabled *bool `url:"enabled,omitempty" json:"enabled,omitempty"`
+}
+
+func ManageJobTokenScope(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if project.JobTokenScope == nil {
+		return nil
+	}
+	changes, err := jobTokenScopeChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch {
+		case change.Kind == jobTokenScopeKind:
+			err = doRequest(client, http.MethodPatch, fmt.Sprintf("projects/%d/job_token_scope", projectId), jobTokenScopeRequest{Enabled: gitlab.Bool(change.Enabled)})
+		case change.Action == actionCreate:
+			err = change.Allowlist.add(change.Name, client)
+		case change.Action == actionDelete:
+			err = change.Allowlist.remove(change.LiveID, client)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": elementPath(project),
+				"Action":  change.Action,
+				"Kind":    change.Kind,
+				"Name":    change.Name,
+			}).Warning("Error ocured while changing job token scope")
+		}
+	}
+	return nil
+}
+
+func planJobTokenScope(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if project.JobTokenScope == nil {
+		return nil, nil
+	}
+	changes, err := jobTokenScopeChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+// importJobTokenScope skips the job token scope on instances which cannot
+// return it, it needs GitLab 16.1 or newer.
+func importJobTokenScope(project *config.GitlabElement, projectId int) error {
+	var live apiJobTokenScope
+	req, err := gitlabClient.NewRequest(http.MethodGet, fmt.Sprintf("projects/%d/job_token_scope", projectId), nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = gitlabClient.Do(req, &live)
+	if isUnavailable(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scope := &config.JobTokenScope{Enabled: gitlab.Bool(live.InboundEnabled)}
+	target := elementPath(*project)
+
+	projects, err := projectAllowlist(projectId).list(gitlabClient)
+	if err != nil {
+		return err
+	}
+	for _, path := range sortedKeys(projects) {
+		if !strings.EqualFold(path, target) {
+			scope.Projects = append(scope.Projects, path)
+		}
+	}
+	groups, err := groupAllowlist(projectId).list(gitlabClient)
+	if err != nil && !isUnavailable(err) {
+		return err
+	}
+	scope.Groups = sortedKeys(groups)
+
+	project.JobTokenScope = scope
+	return nil
+}
+
+// jobTokenScopeRules reports job token scopes which cannot be applied.
+func jobTokenScopeRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	if element.JobTokenScope == nil {
+		return nil
+	}
+	if kind != projectKind {
+		return append(issues, validationIssue{Target: target, Field: "ci_job_token_scope", Message: "Job token scope is only supported on projects", Fatal: true})
+	}
+	for _, problem := range config.CheckJobTokenScope(*element.JobTokenScope) {
+		issues = append(issues, validationIssue{Target: target, Field: "ci_job_token_scope", Message: problem, Fatal: true})
+	}
+	return issues
+}
@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const labelKind = "label"
+
+// labelClient holds the label calls for a project or group. Labels are
+// addressed by name, update renames the label to the name of the desired
+// one.
+type labelClient struct {
+	list   func() ([]*gitlab.Label, error)
+	create func(label config.Label) error
+	update func(name string, label config.Label) error
+	delete func(name string) error
+}
+
+// labelChange is a planned change together with the desired label and the
+// name of the live one.
+type labelChange struct {
+	plannedChange
+	Label    config.Label
+	LiveName string
+}
+
+func labelAttributeChanges(desired config.Label, live *gitlab.Label) []string {
+	var changes []string
+	if config.NormalizeColor(desired.Color) != config.NormalizeColor(live.Color) {
+		changes = append(changes, "color")
+	}
+	if desired.Description != live.Description {
+		changes = append(changes, "description")
+	}
+	if desired.Priority != nil && *desired.Priority != live.Priority {
+		changes = append(changes, "priority")
+	}
+	return changes
+}
+
+// changes compares the labels with the live ones by name. A label missing
+// under its name but present under old_name is renamed.
+func (c labelClient) changes(target string, desired []config.Label, clean bool) ([]labelChange, error) {
+	live, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	liveByName := make(map[string]*gitlab.Label, len(live))
+	for _, l := range live {
+		liveByName[l.Name] = l
+	}
+
+	var changes []labelChange
+	kept := make(map[string]bool, len(desired))
+	for _, l := range desired {
+		change := labelChange{
+			plannedChange: plannedChange{Kind: labelKind, Target: target, Name: l.Name},
+			Label:         l,
+		}
+		current, ok := liveByName[l.Name]
+		if !ok && l.OldName != "" {
+			if current, ok = liveByName[l.OldName]; ok {
+				change.Changes = append(change.Changes, "name")
+			}
+		}
+		if !ok {
+			change.Action = actionCreate
+			changes = append(changes, change)
+			continue
+		}
+
+		kept[current.Name] = true
+		change.Changes = append(change.Changes, labelAttributeChanges(l, current)...)
+		if len(change.Changes) > 0 {
+			change.Action, change.LiveName = actionUpdate, current.Name
+			changes = append(changes, change)
+		}
+	}
+
+	if clean {
+		for _, l := range live {
+			if !kept[l.Name] {
+				changes = append(changes, labelChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: labelKind, Target: target, Name: l.Name},
+					LiveName:      l.Name,
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+func projectLabelClient(projectId int, client *gitlab.Client) labelClient {
+	return labelClient{
+		list: func() ([]*gitlab.Label, error) {
+			var labels []*gitlab.Label
+			opts := &gitlab.ListLabelsOptions{
+				ListOptions:           gitlab.ListOptions{PerPage: 100},
+				IncludeAncestorGroups: gitlab.Bool(false),
+			}
+			for {
+				page, resp, err := client.Labels.ListLabels(projectId, opts)
+				if err != nil {
+					return nil, err
+				}
+				for _, l := range page {
+					if l.IsProjectLabel {
+						labels = append(labels, l)
+					}
+				}
+				if resp.NextPage == 0 {
+					return labels, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(l config.Label) error {
+			_, _, err := client.Labels.CreateLabel(projectId, &gitlab.CreateLabelOptions{
+				Name:        gitlab.String(l.Name),
+				Color:       gitlab.String(l.Color),
+				Description: gitlab.String(l.Description),
+				Priority:    l.Priority,
+			})
+			return err
+		},
+		update: func(name string, l config.Label) error {
+			opt := &gitlab.UpdateLabelOptions{
+				Name:        gitlab.String(name),
+				Color:       gitlab.String(l.Color),
+				Description: gitlab.String(l.Description),
+				Priority:    l.Priority,
+			}
+			if name != l.Name {
+				opt.NewName = gitlab.String(l.Name)
+			}
+			_, _, err := client.Labels.UpdateLabel(projectId, opt)
+			return err
+		},
+		delete: func(name string) error {
+			_, err := client.Labels.DeleteLabel(projectId, &gitlab.DeleteLabelOptions{Name: gitlab.String(name)})
+			return err
+		},
+	}
+}
+
+func groupLabelClient(groupID int, client *gitlab.Client) labelClient {
+	return labelClient{
+		list: func() ([]*gitlab.Label, error) {
+			var labels []*gitlab.Label
+			opts := &gitlab.ListGroupLabelsOptions{
+				ListOptions:           gitlab.ListOptions{PerPage: 100},
+				IncludeAncestorGroups: gitlab.Bool(false),
+				OnlyGroupLabels:       gitlab.Bool(true),
+			}
+			for {
+				page, resp, err := client.GroupLabels.ListGroupLabels(groupID, opts)
+				if err != nil {
+					return nil, err
+				}
+				for _, l := range page {
+					labels = append(labels, (*gitlab.Label)(l))
+				}
+				if resp.NextPage == 0 {
+					return labels, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(l config.Label) error {
+			_, _, err := client.GroupLabels.CreateGroupLabel(groupID, &gitlab.CreateGroupLabelOptions{
+				Name:        gitlab.String(l.Name),
+				Color:       gitlab.String(l.Color),
+				Description: gitlab.String(l.Description),
+			})
+			return err
+		},
+		update: func(name string, l config.Label) error {
+			opt := &gitlab.UpdateGroupLabelOptions{
+				Name:        gitlab.String(name),
+				Color:       gitlab.String(l.Color),
+				Description: gitlab.String(l.Description),
+			}
+			if name != l.Name {
+				opt.NewName = gitlab.String(l.Name)
+			}
+			_, _, err := client.GroupLabels.UpdateGroupLabel(groupID, opt)
+			return err
+		},
+		delete: func(name string) error {
+			_, err := client.GroupLabels.DeleteGroupLabel(groupID, &gitlab.DeleteGroupLabelOptions{Name: gitlab.String(name)})
+			return err
+		},
+	}
+}
+
+func manageLabels(element config.GitlabElement) bool {
+	return len(element.Labels) > 0 || element.CleanUnmanagedLabels
+}
+
+func applyLabels(fields logger.Fields, element config.GitlabElement, c labelClient) error {
+	if !manageLabels(element) {
+		return nil
+	}
+	changes, err := c.changes(elementPath(element), element.Labels, element.CleanUnmanagedLabels)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = c.create(change.Label)
+		case actionUpdate:
+			err = c.update(change.LiveName, change.Label)
+		case actionDelete:
+			err = c.delete(change.LiveName)
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":  err,
+				"Action": change.Action,
+				"Label":  change.Name,
+			}).Warning("Error ocured while changing label")
+		}
+	}
+	return nil
+}
+
+func planLabels(element config.GitlabElement, c labelClient) ([]plannedChange, error) {
+	if !manageLabels(element) {
+		return nil, nil
+	}
+	changes, err := c.changes(elementPath(element), element.Labels, element.CleanUnmanagedLabels)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importLabels(element *config.GitlabElement, c labelClient, withPriority bool) error {
+	labels, err := c.list()
+	if err != nil {
+		return err
+	}
+	for _, l := range labels {
+		label := config.Label{Name: l.Name, Color: l.Color, Description: l.Description}
+		if withPriority && l.Priority != 0 {
+			label.Priority = gitlab.Int(l.Priority)
+		}
+		element.Labels = append(element.Labels, label)
+	}
+	element.CleanUnmanagedLabels = len(labels) > 0
+	return nil
+}
+
+func ManageProjectLabels(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	return applyLabels(logger.Fields{"Project": elementPath(project)}, project, projectLabelClient(projectId, client))
+}
+
+func ManageGroupLabels(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	return applyLabels(logger.Fields{"Group": elementPath(group)}, group, groupLabelClient(groupID, client))
+}
+
+func planProjectLabels(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	return planLabels(project, projectLabelClient(projectId, gitlabClient))
+}
+
+func planGroupLabels(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	return planLabels(group, groupLabelClient(groupID, gitlabClient))
+}
+
+func importProjectLabels(project *config.GitlabElement, projectId int) error {
+	return importLabels(project, projectLabelClient(projectId, gitlabClient), true)
+}
+
+func importGroupLabels(group *config.GitlabElement, groupID int) error {
+	return importLabels(group, groupLabelClient(groupID, gitlabClient), false)
+}
+
+// labelRules reports labels which cannot be applied. A name used as the
+// name or old_name of two labels is ambiguous.
+func labelRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	seen := make(map[string]bool, len(element.Labels))
+	for _, l := range element.Labels {
+		field := "labels." + l.Name
+		names := []string{l.Name}
+		if l.OldName != "" && l.OldName != l.Name {
+			names = append(names, l.OldName)
+		}
+		for _, name := range names {
+			if seen[name] {
+				issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate label " + name, Fatal: true})
+			}
+			seen[name] = true
+		}
+		for _, problem := range config.CheckLabel(l, kind == groupKind) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"fmt"
+	"sheeva/config"
+	"strings"
+	"sync"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// liveMember is a direct member of a project or group as returned by the API.
+type liveMember struct {
+	ID          int
+	Username    string
+	AccessLevel gitlab.AccessLevelValue
+	ExpiresAt   string
+}
+
+func isoDate(t *gitlab.ISOTime) string {
+	if t == nil {
+		return ""
+	}
+	return t.String()
+}
+
+// expiresAt leaves out an empty expiry date, meaning the access never expires.
+func expiresAt(date string) *string {
+	if date == "" {
+		return nil
+	}
+	return gitlab.String(date)
+}
+
+// memberChange is a planned change together with what the API needs to
+// apply it.
+type memberChange struct {
+	plannedChange
+	UserID      int
+	AccessLevel gitlab.AccessLevelValue
+	ExpiresAt   string
+}
+
+var (
+	userIDs   = map[string]int{}
+	userIDsMu sync.Mutex
+
+	tokenUserOnce sync.Once
+	tokenUser     string
+)
+
+// lookupUserID resolves a username once per run.
+func lookupUserID(client *gitlab.Client, username string) (int, error) {
+	userIDsMu.Lock()
+	defer userIDsMu.Unlock()
+
+	if id, ok := userIDs[username]; ok {
+		return id, nil
+	}
+	users, _, err := client.Users.ListUsers(&gitlab.ListUsersOptions{Username: gitlab.String(username)})
+	if err != nil {
+		return 0, err
+	}
+	if len(users) == 0 {
+		return 0, fmt.Errorf("user '%s' not found", username)
+	}
+	userIDs[username] = users[0].ID
+	return users[0].ID, nil
+}
+
+// tokenUsername returns the user the token belongs to, or an empty string
+// when it cannot be determined.
+func tokenUsername(client *gitlab.Client) string {
+	tokenUserOnce.Do(func() {
+		user, _, err := client.Users.CurrentUser()
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error": err,
+			}).Warning("Error while receiving the token user")
+			return
+		}
+		tokenUser = user.Username
+	})
+	return tokenUser
+}
+
+func memberAttributeChanges(level gitlab.AccessLevelValue, expiresAt string, live liveMember) []string {
+	var changes []string
+	if level != live.AccessLevel {
+		changes = append(changes, "access_level")
+	}
+	if expiresAt != live.ExpiresAt {
+		changes = append(changes, "expires_at")
+	}
+	return changes
+}
+
+// diffMembers compares desired members with the live ones. Live members
+// missing from the desired list are removed only when clean is set, and
+// never when it would remove the token's own user or the last owner.
+func diffMembers(client *gitlab.Client, target string, group bool, desired []config.Member, live []liveMember, clean bool) []memberChange {
+	fields := logger.Fields{"Target": target}
+	liveByName := make(map[string]liveMember, len(live))
+	for _, m := range live {
+		liveByName[strings.ToLower(m.Username)] = m
+	}
+
+	var changes []memberChange
+	desiredNames := make(map[string]bool, len(desired))
+	for _, m := range desired {
+		// A rejected member is still declared and must not be removed
+		name := strings.ToLower(m.Username)
+		desiredNames[name] = true
+
+		if problems := config.CheckMember(m, group); len(problems) > 0 {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Problems": strings.Join(problems, "; "),
+				"Member":   m.Username,
+			}).Error("Member rejected by local validation")
+			continue
+		}
+		level, _ := config.ParseAccessLevel(m.AccessLevel)
+
+		current, ok := liveByName[name]
+		if !ok {
+			id, err := lookupUserID(client, m.Username)
+			if err != nil {
+				logger.WithFields(fields).WithFields(logger.Fields{
+					"Error":  err,
+					"Member": m.Username,
+				}).Error("Error while resolving member")
+				continue
+			}
+			changes = append(changes, memberChange{
+				plannedChange: plannedChange{Action: actionCreate, Kind: "member", Target: target, Name: m.Username},
+				UserID:        id,
+				AccessLevel:   level,
+				ExpiresAt:     m.ExpiresAt,
+			})
+			continue
+		}
+		if attributes := memberAttributeChanges(level, m.ExpiresAt, current); len(attributes) > 0 {
+			changes = append(changes, memberChange{
+				plannedChange: plannedChange{Action: actionUpdate, Kind: "member", Target: target, Name: current.Username, Changes: attributes},
+				UserID:        current.ID,
+				AccessLevel:   level,
+				ExpiresAt:     m.ExpiresAt,
+			})
+		}
+	}
+
+	if clean {
+		self := tokenUsername(client)
+		for _, m := range live {
+			if desiredNames[strings.ToLower(m.Username)] {
+				continue
+			}
+			if strings.EqualFold(m.Username, self) {
+				logger.WithFields(fields).WithFields(logger.Fields{
+					"Member": m.Username,
+				}).Warning("Refusing to remove the token's own user")
+				continue
+			}
+			changes = append(changes, memberChange{
+				plannedChange: plannedChange{Action: actionDelete, Kind: "member", Target: target, Name: m.Username},
+				UserID:        m.ID,
+				AccessLevel:   m.AccessLevel,
+			})
+		}
+	}
+
+	return keepLastOwner(fields, live, changes)
+}
+
+// keepLastOwner drops the changes which would leave a project or group that
+// has direct owners without any.
+func keepLastOwner(fields logger.Fields, live []liveMember, changes []memberChange) []memberChange {
+	liveLevels := make(map[int]gitlab.AccessLevelValue, len(live))
+	owners := 0
+	for _, m := range live {
+		liveLevels[m.ID] = m.AccessLevel
+		if m.AccessLevel >= gitlab.OwnerPermissions {
+			owners++
+		}
+	}
+	if owners == 0 {
+		return changes
+	}
+
+	isOwner := func(c memberChange) bool {
+		return c.Action != actionDelete && c.AccessLevel >= gitlab.OwnerPermissions
+	}
+	wasOwner := func(c memberChange) bool {
+		return liveLevels[c.UserID] >= gitlab.OwnerPermissions
+	}
+	losesOwner := func(c memberChange) bool {
+		return wasOwner(c) && !isOwner(c)
+	}
+	remaining := owners
+	for _, c := range changes {
+		switch {
+		case isOwner(c) && !wasOwner(c):
+			remaining++
+		case losesOwner(c):
+			remaining--
+		}
+	}
+	if remaining > 0 {
+		return changes
+	}
+
+	var kept []memberChange
+	for _, c := range changes {
+		if losesOwner(c) {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Member": c.Name,
+			}).Error("Refusing to remove the last owner")
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// memberClient performs member changes on one project or group.
+type memberClient struct {
+	add    func(memberChange) error
+	edit   func(memberChange) error
+	remove func(memberChange) error
+}
+
+func (c memberClient) apply(fields logger.Fields, changes []memberChange) {
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = c.add(change)
+		case actionUpdate:
+			err = c.edit(change)
+		case actionDelete:
+			err = c.remove(change)
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":  err,
+				"Action": change.Action,
+				"Member": change.Name,
+			}).Warning("Error ocured while changing member")
+		}
+	}
+}
+
+// memberRules reports members and shared groups which cannot be applied,
+// e.g. unknown access levels or the same user listed twice.
+func memberRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+
+	seen := make(map[string]bool, len(element.Members))
+	for _, m := range element.Members {
+		field := "members." + m.Username
+		name := strings.ToLower(m.Username)
+		if seen[name] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate member", Fatal: true})
+		}
+		seen[name] = true
+		for _, problem := range config.CheckMember(m, kind == groupKind) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+
+	shared := make(map[string]bool, len(element.SharedWithGroups))
+	for _, s := range element.SharedWithGroups {
+		field := "shared_with_groups." + s.Group
+		path := strings.ToLower(s.Group)
+		if shared[path] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate shared group", Fatal: true})
+		}
+		shared[path] = true
+		for _, problem := range config.CheckSharedGroup(s) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const milestoneKind = "milestone"
+
+// milestoneClient holds the milestone calls for a project or group. update
+// also closes or reopens the milestone when stateEvent is set.
+type milestoneClient struct {
+	list   func() ([]*gitlab.Milestone, error)
+	create func(m config.Milestone) (int, error)
+	update func(id int, m config.Milestone, stateEvent *string) error
+}
+
+// milestoneChange is a planned change together with the desired milestone
+// and the ID of the live one.
+type milestoneChange struct {
+	plannedChange
+	Milestone config.Milestone
+	LiveID    int
+}
+
+// milestoneAttributeChanges lists what differs between a milestone and the
+// live one. Dates left out in the YAML are not managed, GitLab cannot clear
+// them.
+func milestoneAttributeChanges(desired config.Milestone, live *gitlab.Milestone) []string {
+	var changes []string
+	if desired.Description != live.Description {
+		changes = append(changes, "description")
+	}
+	if desired.StartDate != "" && desired.StartDate != isoDate(live.StartDate) {
+		changes = append(changes, "start_date")
+	}
+	if desired.DueDate != "" && desired.DueDate != isoDate(live.DueDate) {
+		changes = append(changes, "due_date")
+	}
+	if desired.DesiredState() != live.State {
+		changes = append(changes, "state")
+	}
+	return changes
+}
+
+// stateEvent returns the event moving a milestone to the desired state.
+func stateEvent(m config.Milestone) *string {
+	if m.DesiredState() == config.MilestoneClosed {
+		return gitlab.String("close")
+	}
+	return gitlab.String("activate")
+}
+
+// changes compares the milestones with the live ones by title. Milestones
+// are never deleted, a finished one is closed.
+func (c milestoneClient) changes(target string, desired []config.Milestone) ([]milestoneChange, error) {
+	live, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	liveByTitle := make(map[string]*gitlab.Milestone, len(live))
+	for _, m := range live {
+		liveByTitle[m.Title] = m
+	}
+
+	var changes []milestoneChange
+	for _, m := range desired {
+		change := milestoneChange{
+			plannedChange: plannedChange{Kind: milestoneKind, Target: target, Name: m.Title},
+			Milestone:     m,
+		}
+		current, ok := liveByTitle[m.Title]
+		switch {
+		case !ok:
+			change.Action = actionCreate
+		case len(milestoneAttributeChanges(m, current)) > 0:
+			change.Action, change.Changes, change.LiveID = actionUpdate, milestoneAttributeChanges(m, current), current.ID
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+func projectMilestoneClient(projectId int, client *gitlab.Client) milestoneClient {
+	return milestoneClient{
+		list: func() ([]*gitlab.Milestone, error) {
+			var milestones []*gitlab.Milestone
+			opts := &gitlab.ListMilestonesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+			for {
+				page, resp, err := client.Milestones.ListMilestones(projectId, opts)
+				if err != nil {
+					return nil, err
+				}
+				milestones = append(milestones, page...)
+				if resp.NextPage == 0 {
+					return milestones, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(m config.Milestone) (int, error) {
+			milestone, _, err := client.Milestones.CreateMilestone(projectId, &gitlab.CreateMilestoneOptions{
+				Title:       gitlab.String(m.Title),
+				Description: gitlab.String(m.Description),
+				StartDate:   isoTime(m.StartDate),
+				DueDate:     isoTime(m.DueDate),
+			})
+			if err != nil {
+				return 0, err
+			}
+			return milestone.ID, nil
+		},
+		update: func(id int, m config.Milestone, stateEvent *string) error {
+			_, _, err := client.Milestones.UpdateMilestone(projectId, id, &gitlab.UpdateMilestoneOptions{
+				Title:       gitlab.String(m.Title),
+				Description: gitlab.String(m.Description),
+				StartDate:   isoTime(m.StartDate),
+				DueDate:     isoTime(m.DueDate),
+				StateEvent:  stateEvent,
+			})
+			return err
+		},
+	}
+}
+
+func groupMilestoneClient(groupID int, client *gitlab.Client) milestoneClient {
+	return milestoneClient{
+		list: func() ([]*gitlab.Milestone, error) {
+			var milestones []*gitlab.Milestone
+			opts := &gitlab.ListGroupMilestonesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+			for {
+				page, resp, err := client.GroupMilestones.ListGroupMilestones(groupID, opts)
+				if err != nil {
+					return nil, err
+				}
+				for _, m := range page {
+					milestones = append(milestones, &gitlab.Milestone{
+						ID:          m.ID,
+						Title:       m.Title,
+						Description: m.Description,
+						StartDate:   m.StartDate,
+						DueDate:     m.DueDate,
+						State:       m.State,
+					})
+				}
+				if resp.NextPage == 0 {
+					return milestones, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(m config.Milestone) (int, error) {
+			milestone, _, err := client.GroupMilestones.CreateGroupMilestone(groupID, &gitlab.CreateGroupMilestoneOptions{
+				Title:       gitlab.String(m.Title),
+				Description: gitlab.String(m.Description),
+				StartDate:   isoTime(m.StartDate),
+				DueDate:     isoTime(m.DueDate),
+			})
+			if err != nil {
+				return 0, err
+			}
+			return milestone.ID, nil
+		},
+		update: func(id int, m config.Milestone, stateEvent *string) error {
+			_, _, err := client.GroupMilestones.UpdateGroupMilestone(groupID, id, &gitlab.UpdateGroupMilestoneOptions{
+				Title:       gitlab.String(m.Title),
+				Description: gitlab.String(m.Description),
+				StartDate:   isoTime(m.StartDate),
+				DueDate:     isoTime(m.DueDate),
+				StateEvent:  stateEvent,
+			})
+			return err
+		},
+	}
+}
+
+func applyMilestones(fields logger.Fields, element config.GitlabElement, c milestoneClient) error {
+	if len(element.Milestones) == 0 {
+		return nil
+	}
+	changes, err := c.changes(elementPath(element), element.Milestones)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			// A milestone is created active and closed afterwards
+			var id int
+			if id, err = c.create(change.Milestone); err == nil && change.Milestone.DesiredState() == config.MilestoneClosed {
+				err = c.update(id, change.Milestone, stateEvent(change.Milestone))
+			}
+		case actionUpdate:
+			var event *string
+			for _, field := range change.Changes {
+				if field == "state" {
+					event = stateEvent(change.Milestone)
+				}
+			}
+			err = c.update(change.LiveID, change.Milestone, event)
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":     err,
+				"Action":    change.Action,
+				"Milestone": change.Name,
+			}).Warning("Error ocured while changing milestone")
+		}
+	}
+	return nil
+}
+
+func planMilestones(element config.GitlabElement, c milestoneClient) ([]plannedChange, error) {
+	if len(element.Milestones) == 0 {
+		return nil, nil
+	}
+	changes, err := c.changes(elementPath(element), element.Milestones)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importMilestones(element *config.GitlabElement, c milestoneClient) error {
+	milestones, err := c.list()
+	if err != nil {
+		return err
+	}
+	for _, m := range milestones {
+		milestone := config.Milestone{
+			Title:       m.Title,
+			Description: m.Description,
+			StartDate:   isoDate(m.StartDate),
+			DueDate:     isoDate(m.DueDate),
+		}
+		if m.State == config.MilestoneClosed {
+			milestone.State = m.State
+		}
+		element.Milestones = append(element.Milestones, milestone)
+	}
+	return nil
+}
+
+func ManageProjectMilestones(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	return applyMilestones(logger.Fields{"Project": elementPath(project)}, project, projectMilestoneClient(projectId, client))
+}
+
+func ManageGroupMilestones(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	return applyMilestones(logger.Fields{"Group": elementPath(group)}, group, groupMilestoneClient(groupID, client))
+}
+
+func planProjectMilestones(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	return planMilestones(project, projectMilestoneClient(projectId, gitlabClient))
+}
+
+func planGroupMilestones(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	return planMilestones(group, groupMilestoneClient(groupID, gitlabClient))
+}
+
+func importProjectMilestones(project *config.GitlabElement, projectId int) error {
+	return importMilestones(project, projectMilestoneClient(projectId, gitlabClient))
+}
+
+func importGroupMilestones(group *config.GitlabElement, groupID int) error {
+	return importMilestones(group, groupMilestoneClient(groupID, gitlabClient))
+}
+
+// milestoneRules reports milestones which cannot be applied.
+func milestoneRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	seen := make(map[string]bool, len(element.Milestones))
+	for _, m := range element.Milestones {
+		field := "milestones." + m.Title
+		if seen[m.Title] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate milestone", Fatal: true})
+		}
+		seen[m.Title] = true
+		for _, problem := range config.CheckMilestone(m) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	mirrorKind     = "mirror"
+	pullMirrorKind = "pull_mirror"
+)
+
+func listMirrors(projectId int, client *gitlab.Client) ([]*gitlab.ProjectMirror, error) {
+	var mirrors []*gitlab.ProjectMirror
+	opts := &gitlab.ListProjectMirrorOptions{PerPage: 100}
+	for {
+		page, resp, err := client.ProjectMirrors.ListProjectMirror(projectId, opts)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, page...)
+		if resp.NextPage == 0 {
+			return mirrors, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// redact removes the credentials of a mirror from an error, GitLab may echo
+// the URL it was given.
+func redact(err error, credentials config.MirrorCredentials, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	for _, s := range append(secrets, credentials.Password) {
+		if s != "" {
+			message = strings.ReplaceAll(message, s, "*****")
+		}
+	}
+	return errors.New(message)
+}
+
+// mirrorChange is a planned change together with the desired mirror and the
+// ID of the live one. Names are URLs without credentials.
+type mirrorChange struct {
+	plannedChange
+	Mirror config.Mirror
+	LiveID int
+}
+
+// rotateMirrorCredentials replaces the push mirrors which have credentials,
+// so a new password reaches GitLab.
+func rotateMirrorCredentials() bool {
+	return os.Getenv("SHEEVA_ROTATE_MIRROR_CREDENTIALS") == "1"
+}
+
+// mirrorChanges compares the push mirrors of the project with the live ones
+// by URL. GitLab masks the credentials of live mirrors and cannot change the
+// URL of a push mirror, so credentials are only set when a mirror is created
+// or replaced on request.
+func mirrorChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]mirrorChange, error) {
+	target := elementPath(project)
+	live, err := listMirrors(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	liveByURL := make(map[string]*gitlab.ProjectMirror, len(live))
+	for _, m := range live {
+		liveByURL[config.StripCredentials(m.URL)] = m
+	}
+
+	var changes []mirrorChange
+	desired := make(map[string]bool, len(project.Mirrors))
+	for _, m := range project.Mirrors {
+		// A rejected mirror stays desired, so it is not cleaned up
+		url := config.StripCredentials(m.URL)
+		desired[url] = true
+		if rejectedMirror(target, url, m.URL, m.MirrorCredentials) {
+			continue
+		}
+		change := mirrorChange{
+			plannedChange: plannedChange{Kind: mirrorKind, Target: target, Name: url},
+			Mirror:        m,
+		}
+		current, ok := liveByURL[url]
+		if !ok {
+			change.Action = actionCreate
+			changes = append(changes, change)
+			continue
+		}
+		if current.Enabled != m.IsEnabled() {
+			change.Changes = append(change.Changes, "enabled")
+		}
+		if current.OnlyProtectedBranches != m.OnlyProtectedBranches {
+			change.Changes = append(change.Changes, "only_protected_branches")
+		}
+		if current.KeepDivergentRefs != m.KeepDivergentRefs {
+			change.Changes = append(change.Changes, "keep_divergent_refs")
+		}
+		switch {
+		case m.Username != "" && rotateMirrorCredentials():
+			change.Changes = append(change.Changes, "credentials")
+			change.Action, change.LiveID = actionReplace, current.ID
+		case len(change.Changes) > 0:
+			change.Action, change.LiveID = actionUpdate, current.ID
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	if project.CleanUnmanagedMirrors {
+		for _, m := range live {
+			url := config.StripCredentials(m.URL)
+			if !desired[url] {
+				changes = append(changes, mirrorChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: mirrorKind, Target: target, Name: url},
+					LiveID:        m.ID,
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// rejectedMirror logs a mirror which fails local validation, by its URL
+// without credentials.
+func rejectedMirror(target, url, rawURL string, credentials config.MirrorCredentials) bool {
+	problems := config.CheckMirror(rawURL, credentials)
+	if len(problems) == 0 {
+		return false
+	}
+	logger.WithFields(logger.Fields{
+		"Problems": strings.Join(problems, "; "),
+		"Project":  target,
+		"Mirror":   url,
+	}).Error("Mirror rejected by local validation")
+	return true
+}
+
+// pullMirrorChange compares the pull mirror of the project with the live
+// one. Enabling mirroring is planned as a create, disabling it as a delete.
+func pullMirrorChange(live *gitlab.Project, project config.GitlabElement) *plannedChange {
+	mirror := project.PullMirror
+	url := config.StripCredentials(mirror.URL)
+	if rejectedMirror(elementPath(project), url, mirror.URL, mirror.MirrorCredentials) {
+		return nil
+	}
+	change := &plannedChange{Kind: pullMirrorKind, Target: elementPath(project), Name: url}
+	switch {
+	case !live.Mirror && mirror.IsEnabled():
+		change.Action = actionCreate
+		return change
+	case live.Mirror && !mirror.IsEnabled():
+		change.Action = actionDelete
+		return change
+	case !mirror.IsEnabled():
+		return nil
+	}
+	if config.StripCredentials(live.ImportURL) != url {
+		change.Changes = append(change.Changes, "url")
+	}
+	if live.MirrorTriggerBuilds != mirror.TriggerBuilds {
+		change.Changes = append(change.Changes, "trigger_builds")
+	}
+	if live.OnlyMirrorProtectedBranches != mirror.OnlyProtectedBranches {
+		change.Changes = append(change.Changes, "only_protected_branches")
+	}
+	if live.MirrorOverwritesDivergedBranches != mirror.OverwritesDivergedBranches {
+		change.Changes = append(change.Changes, "overwrites_diverged_branches")
+	}
+	if len(change.Changes) == 0 {
+		return nil
+	}
+	change.Action = actionUpdate
+	return change
+}
+
+func manageMirrors(project config.GitlabElement) bool {
+	return len(project.Mirrors) > 0 || project.CleanUnmanagedMirrors
+}
+
+func applyMirrors(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	changes, err := mirrorChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		m := change.Mirror
+		opt := &gitlab.EditProjectMirrorOptions{
+			Enabled:               gitlab.Bool(m.IsEnabled()),
+			OnlyProtectedBranches: gitlab.Bool(m.OnlyProtectedBranches),
+			KeepDivergentRefs:     gitlab.Bool(m.KeepDivergentRefs),
+		}
+		var authURL string
+		add := func() (err error) {
+			if authURL, err = m.AuthenticatedURL(m.URL); err != nil {
+				return err
+			}
+			_, _, err = client.ProjectMirrors.AddProjectMirror(projectId, &gitlab.AddProjectMirrorOptions{
+				URL:                   gitlab.String(authURL),
+				Enabled:               opt.Enabled,
+				OnlyProtectedBranches: opt.OnlyProtectedBranches,
+				KeepDivergentRefs:     opt.KeepDivergentRefs,
+			})
+			return err
+		}
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = add()
+		case actionReplace:
+			// The password is resolved first, so a failure keeps the mirror
+			if _, err = m.AuthenticatedURL(m.URL); err == nil {
+				if _, err = client.ProjectMirrors.DeleteProjectMirror(projectId, change.LiveID); err == nil {
+					err = add()
+				}
+			}
+		case actionUpdate:
+			_, _, err = client.ProjectMirrors.EditProjectMirror(projectId, change.LiveID, opt)
+		case actionDelete:
+			_, err = client.ProjectMirrors.DeleteProjectMirror(projectId, change.LiveID)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   redact(err, m.MirrorCredentials, authURL),
+				"Project": elementPath(project),
+				"Action":  change.Action,
+				"Mirror":  change.Name,
+			}).Warning("Error ocured while changing mirror")
+		}
+	}
+	return nil
+}
+
+func applyPullMirror(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	live, _, err := client.Projects.GetProject(projectId, nil)
+	if err != nil {
+		return err
+	}
+	change := pullMirrorChange(live, project)
+	if change == nil {
+		return nil
+	}
+
+	mirror := project.PullMirror
+	opt := &gitlab.EditProjectOptions{Mirror: gitlab.Bool(mirror.IsEnabled())}
+	var authURL string
+	if mirror.IsEnabled() {
+		// The URL is always sent, GitLab keeps no credentials it cannot show
+		authURL, err = mirror.AuthenticatedURL(mirror.URL)
+		opt.ImportURL = gitlab.String(authURL)
+		opt.MirrorTriggerBuilds = gitlab.Bool(mirror.TriggerBuilds)
+		opt.OnlyMirrorProtectedBranches = gitlab.Bool(mirror.OnlyProtectedBranches)
+		opt.MirrorOverwritesDivergedBranches = gitlab.Bool(mirror.OverwritesDivergedBranches)
+	}
+	var updated *gitlab.Project
+	if err == nil {
+		updated, _, err = client.Projects.EditProject(projectId, opt)
+	}
+	// Instances without pull mirroring ignore the setting
+	if err == nil && updated.Mirror != mirror.IsEnabled() {
+		err = errors.New("pull mirrors are not available on this instance, GitLab Premium is required")
+	}
+	if err != nil {
+		logger.WithFields(logger.Fields{
+			"Error":   redact(err, mirror.MirrorCredentials, authURL),
+			"Project": elementPath(project),
+			"Action":  change.Action,
+			"Mirror":  change.Name,
+		}).Warning("Error ocured while changing pull mirror")
+	}
+	return nil
+}
+
+func ManageMirrors(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if manageMirrors(project) {
+		if err := applyMirrors(projectId, project, client); err != nil {
+			return err
+		}
+	}
+	if project.PullMirror != nil {
+		return applyPullMirror(projectId, project, client)
+	}
+	return nil
+}
+
+func planMirrors(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	var all []plannedChange
+	if manageMirrors(project) {
+		changes, err := mirrorChanges(projectId, project, gitlabClient)
+		if err != nil {
+			return nil, err
+		}
+		all = planned(changes)
+	}
+	if project.PullMirror != nil {
+		live, _, err := gitlabClient.Projects.GetProject(projectId, nil)
+		if err != nil {
+			return nil, err
+		}
+		if change := pullMirrorChange(live, project); change != nil {
+			all = append(all, *change)
+		}
+	}
+	return all, nil
+}
+
+// importMirrors imports the mirrors without their credentials, which GitLab
+// does not show.
+func importMirrors(project *config.GitlabElement, projectId int) error {
+	mirrors, err := listMirrors(projectId, gitlabClient)
+	if err != nil {
+		return err
+	}
+	for _, m := range mirrors {
+		mirror := config.Mirror{
+			URL:                   config.StripCredentials(m.URL),
+			OnlyProtectedBranches: m.OnlyProtectedBranches,
+			KeepDivergentRefs:     m.KeepDivergentRefs,
+		}
+		if !m.Enabled {
+			mirror.Enabled = gitlab.Bool(false)
+		}
+		project.Mirrors = append(project.Mirrors, mirror)
+	}
+	project.CleanUnmanagedMirrors = len(mirrors) > 0
+
+	live, _, err := gitlabClient.Projects.GetProject(projectId, nil)
+	if err != nil {
+		return err
+	}
+	if live.Mirror {
+		project.PullMirror = &config.PullMirror{
+			URL:                        config.StripCredentials(live.ImportURL),
+			TriggerBuilds:              live.MirrorTriggerBuilds,
+			OnlyProtectedBranches:      live.OnlyMirrorProtectedBranches,
+			OverwritesDivergedBranches: live.MirrorOverwritesDivergedBranches,
+		}
+	}
+	return nil
+}
+
+// mirrorRules reports mirrors which cannot be applied. Passwords written in
+// the YAML are allowed, but password_from is preferred.
+func mirrorRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	if kind != projectKind {
+		if len(element.Mirrors) > 0 || element.PullMirror != nil {
+			issues = append(issues, validationIssue{Target: target, Field: "mirrors", Message: "Mirrors are only supported on projects", Fatal: true})
+		}
+		return issues
+	}
+
+	checkCredentials := func(field string, credentials config.MirrorCredentials) {
+		if credentials.Password != "" {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Password is stored in plain text, use password_from"})
+		}
+	}
+
+	seen := make(map[string]bool, len(element.Mirrors))
+	for _, m := range element.Mirrors {
+		url := config.StripCredentials(m.URL)
+		field := "mirrors." + url
+		if seen[url] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate mirror", Fatal: true})
+		}
+		seen[url] = true
+		for _, problem := range config.CheckMirror(m.URL, m.MirrorCredentials) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+		checkCredentials(field, m.MirrorCredentials)
+	}
+
+	if m := element.PullMirror; m != nil {
+		for _, problem := range config.CheckMirror(m.URL, m.MirrorCredentials) {
+			issues = append(issues, validationIssue{Target: target, Field: "pull_mirror", Message: problem, Fatal: true})
+		}
+		checkCredentials("pull_mirror", m.MirrorCredentials)
+	}
+	return issues
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"fmt"
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	actionCreate  = "create"
+	actionUpdate  = "update"
+	actionDelete  = "delete"
+	actionReplace = "replace"
+	actionRotate  = "rotate"
+)
+
+// plannedChange is a single difference between the YAML and GitLab. It never
+// carries values, so plans can be published in merge requests.
+type plannedChange struct {
+	Action  string
+	Kind    string
+	Target  string
+	Name    string
+	Changes []string
+}
+
+func (c plannedChange) log() {
+	fields := logger.Fields{
+		"Action": c.Action,
+		"Kind":   c.Kind,
+		"Target": c.Target,
+	}
+	if c.Name != "" {
+		fields["Name"] = c.Name
+	}
+	if len(c.Changes) > 0 {
+		fields["Changes"] = strings.Join(c.Changes, ",")
+	}
+	logger.WithFields(fields).Info("Planned change")
+}
+
+// change lets the change structs of every resource, which embed
+// plannedChange, be reduced to it.
+func (c plannedChange) change() plannedChange {
+	return c
+}
+
+// planned strips the details needed to apply changes, leaving what a plan
+// shows.
+func planned[T interface{ change() plannedChange }](changes []T) []plannedChange {
+	result := make([]plannedChange, 0, len(changes))
+	for _, c := range changes {
+		result = append(result, c.change())
+	}
+	return result
+}
+
+// planner computes the changes of one aspect of an existing group or project.
+type planner func(element config.GitlabElement, id int) ([]plannedChange, error)
+
+var (
+	groupPlanners   = []planner{planGroupVariables, planGroupMembers, planGroupSharedGroups, planGroupLinks, planGroupApprovals, planGroupPushRules, planGroupTokens, planGroupLabels, planGroupMilestones, planGroupBadges, planGroupProtectedEnvironments, planGroupRegistryDefaults}
+	projectPlanners = []planner{planProjectVariables, planProjectMembers, planProjectSharedGroups, planDeployKeys, planProtectedBranches, planProtectedTags, planProjectApprovals, planProjectPushRules, planProjectTokens, planProjectLabels, planProjectMilestones, planProjectBadges, planEnvironments, planProjectProtectedEnvironments, planTriggers, planJobTokenScope, planMirrors, planProjectRegistry}
+)
+
+// Plan validates the configuration and prints what applying it would change,
+// without changing anything.
+func Plan() error {
+	if err := validate(gitlabVersion(), true); err != nil {
+		return err
+	}
+
+	var changes []plannedChange
+	var failed int
+	run := func(planners []planner, element config.GitlabElement, id int) {
+		for _, p := range planners {
+			c, err := p(element, id)
+			if err != nil {
+				failed++
+				logger.WithFields(logger.Fields{
+					"Error":  err,
+					"Target": elementPath(element),
+				}).Error("Error while planning changes")
+				continue
+			}
+			changes = append(changes, c...)
+		}
+	}
+
+	if !instance.IsEmpty() {
+		c, err := planInstanceVariables()
+		if err != nil {
+			failed++
+			logger.WithFields(logger.Fields{
+				"Error":  err,
+				"Target": instanceKind,
+			}).Error("Error while planning changes")
+		}
+		changes = append(changes, c...)
+	}
+
+	for _, g := range groups {
+		path := elementPath(g)
+		groupID, err := GetGroupID(path, gitlabClient)
+		switch {
+		case err != nil && g.State == "present":
+			changes = append(changes, plannedChange{Action: actionCreate, Kind: groupKind, Target: path})
+		case err != nil:
+		case g.State == "absent":
+			changes = append(changes, plannedChange{Action: actionDelete, Kind: groupKind, Target: path})
+		default:
+			run(groupPlanners, g, groupID)
+		}
+	}
+
+	for _, p := range projects {
+		path := p.Namespace + "/" + p.Name
+		projectId, err := GetProjectId(path, gitlabClient)
+		switch {
+		case err != nil && p.State == "present":
+			changes = append(changes, plannedChange{Action: actionCreate, Kind: projectKind, Target: path})
+		case err != nil:
+		case p.State == "absent":
+			changes = append(changes, plannedChange{Action: actionDelete, Kind: projectKind, Target: path})
+		case p.State == "archive":
+			changes = append(changes, plannedChange{Action: actionUpdate, Kind: projectKind, Target: path, Changes: []string{"archived"}})
+		default:
+			run(projectPlanners, p, projectId)
+		}
+	}
+
+	for _, c := range changes {
+		c.log()
+	}
+	logger.WithFields(logger.Fields{
+		"Changes": len(changes),
+		"Failed":  failed,
+	}).Info("Plan finished")
+
+	if failed > 0 {
+		return fmt.Errorf("%d targets could not be planned", failed)
+	}
+	return nil
+}
@@ -59,7 +59,108 @@ func manageProject(project config.GitlabElement, client *gitlab.Client) error {
 				}).Error("Error while upload project avatar")
 			}
 		}
-		ManageProjectVariables(pId, project, client)
+		if err := ManageProjectVariables(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing project variables")
+		}
+		if err := ManageProjectMembers(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing project members")
+		}
+		if err := ManageProjectSharedGroups(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing project shared groups")
+		}
+		if err := ManageDeployKeys(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing deploy keys")
+		}
+		if err := ManageProtectedBranches(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing protected branches")
+		}
+		if err := ManageProtectedTags(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing protected tags")
+		}
+		if err := ManageProjectApprovals(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing approvals")
+		}
+		if err := ManageProjectPushRules(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing push rules")
+		}
+		if err := ManageProjectTokens(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing tokens")
+		}
+		if err := ManageProjectLabels(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing labels")
+		}
+		if err := ManageProjectMilestones(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing milestones")
+		}
+		if err := ManageProjectBadges(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing badges")
+		}
+		if err := ManageEnvironments(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing environments")
+		}
+		if err := ManageProjectProtectedEnvironments(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing protected environments")
+		}
+		if err := ManageTriggers(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing triggers")
+		}
+		if err := ManageJobTokenScope(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing job token scope")
+		}
+		if err := ManageMirrors(pId, project, client); err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": projectPath,
+			}).Error("Error while managing mirrors")
+		}
 		err := EditProjectSetting(pId, project, client)
 		if err != nil {
 			logger.WithFields(logger.Fields{
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func ManageProjectMembers(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if len(project.Members) == 0 && !project.CleanUnmanagedMembers {
+		return nil
+	}
+	changes, err := projectMemberChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	memberClient{
+		add: func(c memberChange) error {
+			_, _, err := client.ProjectMembers.AddProjectMember(projectId, &gitlab.AddProjectMemberOptions{
+				UserID:      c.UserID,
+				AccessLevel: gitlab.AccessLevel(c.AccessLevel),
+				ExpiresAt:   expiresAt(c.ExpiresAt),
+			})
+			return err
+		},
+		edit: func(c memberChange) error {
+			_, _, err := client.ProjectMembers.EditProjectMember(projectId, c.UserID, &gitlab.EditProjectMemberOptions{
+				AccessLevel: gitlab.AccessLevel(c.AccessLevel),
+				ExpiresAt:   gitlab.String(c.ExpiresAt),
+			})
+			return err
+		},
+		remove: func(c memberChange) error {
+			_, err := client.ProjectMembers.DeleteProjectMember(projectId, c.UserID)
+			return err
+		},
+	}.apply(logger.Fields{"Project": elementPath(project)}, changes)
+	return nil
+}
+
+func listProjectMembers(projectId int, client *gitlab.Client) ([]liveMember, error) {
+	var members []liveMember
+	opts := &gitlab.ListProjectMembersOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := client.ProjectMembers.ListProjectMembers(projectId, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page {
+			members = append(members, liveMember{
+				ID:          m.ID,
+				Username:    m.Username,
+				AccessLevel: m.AccessLevel,
+				ExpiresAt:   isoDate(m.ExpiresAt),
+			})
+		}
+		if resp.NextPage == 0 {
+			return members, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func projectMemberChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]memberChange, error) {
+	live, err := listProjectMembers(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	return diffMembers(client, elementPath(project), false, project.Members, live, project.CleanUnmanagedMembers), nil
+}
+
+func planProjectMembers(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if len(project.Members) == 0 && !project.CleanUnmanagedMembers {
+		return nil, nil
+	}
+	changes, err := projectMemberChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
@@ -36,7 +36,15 @@ func ManageSchedules(projectId int, project config.GitlabElement, client *gitlab
 			}).Debug("Error ocured while creating project pipeline schedule")
 			return err
 		} else {
-			for _, variable := range sched.Variables {
+			variables, errs := config.ResolveVariables(sched.Variables)
+			for id, err := range errs {
+				logger.WithFields(logger.Fields{
+					"Error":    err,
+					"Project":  project.Namespace + "/" + project.Name,
+					"Variable": id,
+				}).Error("Error ocured while resolving pipeline schedule variable value")
+			}
+			for _, variable := range variables {
 				err := createPipelineScheduleVariable(projectId, Schedule.ID, variable, client)
 				if err != nil {
 					logger.WithFields(logger.Fields{
@@ -21,9 +21,12 @@ func EditProjectSetting(projectId int, project config.GitlabElement, client *git
 }
 
 func editProjectSettingOpts(project config.GitlabElement) *gitlab.EditProjectOptions {
-	return &gitlab.EditProjectOptions{
+	opt := &gitlab.EditProjectOptions{
 		CIConfigPath:                 gitlab.String(project.CIConfigPath),
 		RemoveSourceBranchAfterMerge: gitlab.Bool(false),
 		CIForwardDeploymentEnabled:   gitlab.Bool(false),
 	}
+	policy, settings := effectiveRegistry(project)
+	registryOpts(opt, policy, settings)
+	return opt
 }
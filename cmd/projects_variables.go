@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
 	"sheeva/config"
 
 	logger "github.com/sirupsen/logrus"
@@ -9,49 +12,36 @@ import (
 
 // Можно параллелить вполне целиком эту функцию
 func ManageProjectVariables(projectId int, project config.GitlabElement, client *gitlab.Client) error {
-	if project.CleanUnmanagedVars {
-		if err := CleanUnmanagedVariablesProject(projectId, client); err != nil {
-			logger.WithFields(logger.Fields{
-				"Error":   err,
-				"Project": project.Namespace + "/" + project.Name,
-			}).Warning("Error ocured while remove unamanaged variables")
-		}
-	}
-
-	variablesFile := project.VariablesFile
-	if variablesFile != "" {
-		fileVariables, err := config.ParseVariableFile(project.VariablesFile)
-		if err != nil {
-			logger.WithFields(logger.Fields{
-				"Error":   err,
-				"Project": project.Namespace + "/" + project.Name,
-			}).Error("Error ocured while parsing variable file")
-		}
-		project.Variables = append(project.Variables, fileVariables.Variables...)
+	fields := logger.Fields{"Project": project.Namespace + "/" + project.Name}
+	live, err := listProjectVariables(projectId, client)
+	if err != nil {
+		return err
 	}
+	variables, clean := desiredVariables(fields, project, config.CheckVariable)
 
-	for _, variable := range project.Variables {
-		err := CreateProjectVariable(projectId, variable, client)
-		if err != nil {
-			err = UpdateProjectVariable(projectId, variable, client)
-			if err != nil {
-				logger.WithFields(logger.Fields{
-					"Error":    err,
-					"Project":  project.Namespace + "/" + project.Name,
-					"Variable": variable.Key,
-				}).Warning("Error ocured while create variable")
-			}
-		}
-	}
+	variableClient{
+		create: func(v config.Variable) error { return CreateProjectVariable(projectId, v, client) },
+		update: func(v config.Variable) error { return UpdateProjectVariable(projectId, v, client) },
+		remove: func(v config.Variable) error { return RemoveProjectVariable(projectId, v, client) },
+	}.apply(fields, diffVariables(elementPath(project), variables, live, clean))
 	return nil
 }
 
+type createProjectVariableRequest struct {
+	*gitlab.CreateProjectVariableOptions
+	variableAttributes
+}
+
+type updateProjectVariableRequest struct {
+	*gitlab.UpdateProjectVariableOptions
+	variableAttributes
+}
+
 func CreateProjectVariable(projectID int, variable config.Variable, client *gitlab.Client) error {
-	_, _, err := client.ProjectVariables.CreateVariable(projectID, createProjectVariableOptions(variable))
-	if err != nil {
-		return err
-	}
-	return nil
+	return doRequest(client, http.MethodPost, fmt.Sprintf("projects/%d/variables", projectID), createProjectVariableRequest{
+		createProjectVariableOptions(variable),
+		newVariableAttributes(variable, true),
+	})
 }
 
 func createProjectVariableOptions(variable config.Variable) *gitlab.CreateProjectVariableOptions {
@@ -61,17 +51,17 @@ func createProjectVariableOptions(variable config.Variable) *gitlab.CreateProjec
 		VariableType:     gitlab.VariableType(gitlab.VariableTypeValue(variable.VariableType)),
 		Protected:        gitlab.Bool(variable.Protected),
 		Masked:           gitlab.Bool(variable.Masked),
+		Raw:              gitlab.Bool(variable.Raw),
 		EnvironmentScope: gitlab.String(variable.Environment),
 	}
 	return ProjectVariableOpts
 }
 
 func UpdateProjectVariable(projectID int, variable config.Variable, client *gitlab.Client) error {
-	_, _, err := client.ProjectVariables.UpdateVariable(projectID, variable.Key, updateProjectVariableOptions(variable))
-	if err != nil {
-		return err
-	}
-	return nil
+	return doRequest(client, http.MethodPut, fmt.Sprintf("projects/%d/variables/%s", projectID, url.PathEscape(variable.Key)), updateProjectVariableRequest{
+		updateProjectVariableOptions(variable),
+		newVariableAttributes(variable, false),
+	})
 }
 
 func updateProjectVariableOptions(variable config.Variable) *gitlab.UpdateProjectVariableOptions {
@@ -80,25 +70,16 @@ func updateProjectVariableOptions(variable config.Variable) *gitlab.UpdateProjec
 		VariableType:     gitlab.VariableType(gitlab.VariableTypeValue(variable.VariableType)),
 		Protected:        gitlab.Bool(variable.Protected),
 		Masked:           gitlab.Bool(variable.Masked),
+		Raw:              gitlab.Bool(variable.Raw),
 		EnvironmentScope: gitlab.String(variable.Environment),
-		Filter:           &gitlab.VariableFilter{EnvironmentScope: variable.Environment},
+		Filter:           variableFilter(variable),
 	}
 	return UpdateProjectVariableOpts
 }
 
-func CleanUnmanagedVariablesProject(projectId int, client *gitlab.Client) error {
-	vars, _, err := client.ProjectVariables.ListVariables(projectId, &gitlab.ListProjectVariablesOptions{})
-	if err != nil {
-		return err
-	}
-	for _, v := range vars {
-		_, err := client.ProjectVariables.RemoveVariable(projectId, v.Key, &gitlab.RemoveProjectVariableOptions{
-			Filter: &gitlab.VariableFilter{EnvironmentScope: v.EnvironmentScope},
-		})
-		if err != nil {
-			return err
-		}
-
-	}
-	return nil
+func RemoveProjectVariable(projectID int, variable config.Variable, client *gitlab.Client) error {
+	_, err := client.ProjectVariables.RemoveVariable(projectID, variable.Key, &gitlab.RemoveProjectVariableOptions{
+		Filter: variableFilter(variable),
+	})
+	return err
 }
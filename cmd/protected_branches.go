@@ -0,0 +1,379 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const protectedBranchKind = "protected_branch"
+
+// apiProtectedBranch is a protected branch as returned by the API.
+type apiProtectedBranch struct {
+	ID                        int              `json:"id"`
+	Name                      string           `json:"name"`
+	PushAccessLevels          []apiAccessLevel `json:"push_access_levels"`
+	MergeAccessLevels         []apiAccessLevel `json:"merge_access_levels"`
+	UnprotectAccessLevels     []apiAccessLevel `json:"unprotect_access_levels"`
+	AllowForcePush            bool             `json:"allow_force_push"`
+	CodeOwnerApprovalRequired bool             `json:"code_owner_approval_required"`
+}
+
+func listProtectedBranches(projectId int, client *gitlab.Client) ([]apiProtectedBranch, error) {
+	var branches []apiProtectedBranch
+	opts := &gitlab.ListOptions{PerPage: 100}
+	for {
+		req, err := client.NewRequest(http.MethodGet, fmt.Sprintf("projects/%d/protected_branches", projectId), opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []apiProtectedBranch
+		resp, err := client.Do(req, &page)
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, page...)
+		if resp.NextPage == 0 {
+			return branches, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// branchProtection is a protected branch with its access rules resolved.
+type branchProtection struct {
+	Name                      string
+	Push                      []accessRule
+	Merge                     []accessRule
+	Unprotect                 []accessRule
+	AllowForcePush            bool
+	CodeOwnerApprovalRequired bool
+}
+
+func (r *accessResolver) desiredBranch(b config.ProtectedBranch) (branchProtection, error) {
+	protection := branchProtection{
+		Name:                      b.Name,
+		AllowForcePush:            b.AllowForcePush,
+		CodeOwnerApprovalRequired: b.CodeOwnerApprovalRequired,
+	}
+	var err error
+	if protection.Push, err = r.desired(b.PushAccessLevel, gitlab.MaintainerPermissions, b.AllowedToPush); err != nil {
+		return protection, err
+	}
+	if protection.Merge, err = r.desired(b.MergeAccessLevel, gitlab.MaintainerPermissions, b.AllowedToMerge); err != nil {
+		return protection, err
+	}
+	protection.Unprotect, err = r.desired(b.UnprotectAccessLevel, gitlab.MaintainerPermissions, b.AllowedToUnprotect)
+	return protection, err
+}
+
+func (r *accessResolver) liveBranch(b apiProtectedBranch) (branchProtection, error) {
+	protection := branchProtection{
+		Name:                      b.Name,
+		AllowForcePush:            b.AllowForcePush,
+		CodeOwnerApprovalRequired: b.CodeOwnerApprovalRequired,
+	}
+	var err error
+	if protection.Push, err = r.live(b.PushAccessLevels, gitlab.MaintainerPermissions); err != nil {
+		return protection, err
+	}
+	if protection.Merge, err = r.live(b.MergeAccessLevels, gitlab.MaintainerPermissions); err != nil {
+		return protection, err
+	}
+	protection.Unprotect, err = r.live(b.UnprotectAccessLevels, gitlab.MaintainerPermissions)
+	return protection, err
+}
+
+func (b branchProtection) toConfig() config.ProtectedBranch {
+	branch := config.ProtectedBranch{
+		Name:                      b.Name,
+		AllowForcePush:            b.AllowForcePush,
+		CodeOwnerApprovalRequired: b.CodeOwnerApprovalRequired,
+	}
+	branch.PushAccessLevel, branch.AllowedToPush = accessConfig(b.Push)
+	branch.MergeAccessLevel, branch.AllowedToMerge = accessConfig(b.Merge)
+	branch.UnprotectAccessLevel, branch.AllowedToUnprotect = accessConfig(b.Unprotect)
+	return branch
+}
+
+func branchProtectionChanges(desired, live branchProtection) []string {
+	var changes []string
+	if !sameAccessRules(desired.Push, live.Push) {
+		changes = append(changes, "push_access_levels")
+	}
+	if !sameAccessRules(desired.Merge, live.Merge) {
+		changes = append(changes, "merge_access_levels")
+	}
+	if !sameAccessRules(desired.Unprotect, live.Unprotect) {
+		changes = append(changes, "unprotect_access_levels")
+	}
+	if desired.AllowForcePush != live.AllowForcePush {
+		changes = append(changes, "allow_force_push")
+	}
+	if desired.CodeOwnerApprovalRequired != live.CodeOwnerApprovalRequired {
+		changes = append(changes, "code_owner_approval_required")
+	}
+	return changes
+}
+
+// branchChange is a planned change together with both protections.
+type branchChange struct {
+	plannedChange
+	Desired branchProtection
+	Live    branchProtection
+}
+
+// protectedBranchChanges compares the protected branches of the project with
+// the live ones. Protections are matched by name, so a wildcard is a
+// protection of its own and not of the branches it matches.
+func protectedBranchChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]branchChange, error) {
+	target := elementPath(project)
+	resolver := newAccessResolver(client, projectId)
+
+	apiBranches, err := listProtectedBranches(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]branchProtection, len(apiBranches))
+	for _, b := range apiBranches {
+		protection, err := resolver.liveBranch(b)
+		if err != nil {
+			return nil, err
+		}
+		live[b.Name] = protection
+	}
+
+	var changes []branchChange
+	desiredNames := make(map[string]bool, len(project.ProtectedBranches))
+	for _, b := range project.ProtectedBranches {
+		desiredNames[b.Name] = true
+		desired, err := resolver.desiredBranch(b)
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": target,
+				"Branch":  b.Name,
+			}).Error("Error while resolving protected branch")
+			continue
+		}
+
+		current, ok := live[b.Name]
+		if !ok {
+			changes = append(changes, branchChange{
+				plannedChange: plannedChange{Action: actionCreate, Kind: protectedBranchKind, Target: target, Name: b.Name},
+				Desired:       desired,
+			})
+			continue
+		}
+		if attributes := branchProtectionChanges(desired, current); len(attributes) > 0 {
+			action := actionUpdate
+			if !canUpdateProtections() {
+				action = actionReplace
+			}
+			changes = append(changes, branchChange{
+				plannedChange: plannedChange{Action: action, Kind: protectedBranchKind, Target: target, Name: b.Name, Changes: attributes},
+				Desired:       desired,
+				Live:          current,
+			})
+		}
+	}
+
+	if project.CleanUnmanagedBranches {
+		for _, b := range apiBranches {
+			if !desiredNames[b.Name] {
+				changes = append(changes, branchChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: protectedBranchKind, Target: target, Name: b.Name},
+					Live:          live[b.Name],
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// canUpdateProtections reports whether GitLab can change the access levels
+// of an existing protection. Older versions need it to be recreated.
+func canUpdateProtections() bool {
+	return gitlabVersion().AtLeast(15, 6)
+}
+
+func manageProtectedBranches(project config.GitlabElement) bool {
+	return len(project.ProtectedBranches) > 0 || project.CleanUnmanagedBranches
+}
+
+func ManageProtectedBranches(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if !manageProtectedBranches(project) {
+		return nil
+	}
+	changes, err := protectedBranchChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = ProtectBranch(projectId, change.Desired, client)
+		case actionUpdate:
+			err = UpdateProtectedBranch(projectId, change.Desired, change.Live, client)
+		case actionReplace:
+			if err = UnprotectBranch(projectId, change.Name, client); err == nil {
+				err = ProtectBranch(projectId, change.Desired, client)
+			}
+		case actionDelete:
+			err = UnprotectBranch(projectId, change.Name, client)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": elementPath(project),
+				"Action":  change.Action,
+				"Branch":  change.Name,
+			}).Warning("Error ocured while changing protected branch")
+		}
+	}
+	return nil
+}
+
+// protectBranchRequest sends the access rules as allowed_to_* lists, which
+// unlike the go-gitlab options can name deploy keys and roles side by side.
+type protectBranchRequest struct {
+	Name                      *string                  `url:"name,omitempty" json:"name,omitempty"`
+	AllowedToPush             []*accessPermission      `url:"allowed_to_push,omitempty" json:"allowed_to_push,omitempty"`
+	AllowedToMerge            []*accessPermission      `url:"allowed_to_merge,omitempty" json:"allowed_to_merge,omitempty"`
+	AllowedToUnprotect        []*accessPermission      `url:"allowed_to_unprotect,omitempty" json:"allowed_to_unprotect,omitempty"`
+	AllowForcePush            *bool                    `url:"allow_force_push,omitempty" json:"allow_force_push,omitempty"`
+	CodeOwnerApprovalRequired *bool                    `url:"code_owner_approval_required,omitempty" json:"code_owner_approval_required,omitempty"`
+	PushAccessLevel           *gitlab.AccessLevelValue `url:"push_access_level,omitempty" json:"push_access_level,omitempty"`
+	MergeAccessLevel          *gitlab.AccessLevelValue `url:"merge_access_level,omitempty" json:"merge_access_level,omitempty"`
+	UnprotectAccessLevel      *gitlab.AccessLevelValue `url:"unprotect_access_level,omitempty" json:"unprotect_access_level,omitempty"`
+}
+
+// splitAccessRules passes a single role as the *_access_level parameter,
+// which GitLab Free accepts, and everything else as allowed_to_* entries.
+func splitAccessRules(rules []accessRule) (*gitlab.AccessLevelValue, []*accessPermission) {
+	var level *gitlab.AccessLevelValue
+	var others []accessRule
+	for _, r := range rules {
+		if r.Kind == ruleAccessLevel && level == nil {
+			level = gitlab.AccessLevel(r.Level)
+			continue
+		}
+		others = append(others, r)
+	}
+	if len(others) == 0 {
+		return level, nil
+	}
+	return level, accessPermissions(others)
+}
+
+func ProtectBranch(projectId int, b branchProtection, client *gitlab.Client) error {
+	opt := protectBranchRequest{
+		Name:                      gitlab.String(b.Name),
+		AllowForcePush:            gitlab.Bool(b.AllowForcePush),
+		CodeOwnerApprovalRequired: gitlab.Bool(b.CodeOwnerApprovalRequired),
+	}
+	opt.PushAccessLevel, opt.AllowedToPush = splitAccessRules(b.Push)
+	opt.MergeAccessLevel, opt.AllowedToMerge = splitAccessRules(b.Merge)
+	opt.UnprotectAccessLevel, opt.AllowedToUnprotect = splitAccessRules(b.Unprotect)
+	return doRequest(client, http.MethodPost, fmt.Sprintf("projects/%d/protected_branches", projectId), opt)
+}
+
+// UpdateProtectedBranch changes a protection in place, so the branch is not
+// left unprotected in between. GitLab Free accepts the allowed_to_* entries
+// but silently ignores them, so the protection is read back to tell.
+func UpdateProtectedBranch(projectId int, desired, live branchProtection, client *gitlab.Client) error {
+	opt := protectBranchRequest{
+		AllowedToPush:             accessPermissionUpdates(desired.Push, live.Push),
+		AllowedToMerge:            accessPermissionUpdates(desired.Merge, live.Merge),
+		AllowedToUnprotect:        accessPermissionUpdates(desired.Unprotect, live.Unprotect),
+		AllowForcePush:            gitlab.Bool(desired.AllowForcePush),
+		CodeOwnerApprovalRequired: gitlab.Bool(desired.CodeOwnerApprovalRequired),
+	}
+	branchPath := fmt.Sprintf("projects/%d/protected_branches/%s", projectId, url.PathEscape(desired.Name))
+	if err := doRequest(client, http.MethodPatch, branchPath, opt); err != nil {
+		return err
+	}
+
+	req, err := client.NewRequest(http.MethodGet, branchPath, nil, nil)
+	if err != nil {
+		return err
+	}
+	var updated apiProtectedBranch
+	if _, err := client.Do(req, &updated); err != nil {
+		return err
+	}
+	current, err := newAccessResolver(client, projectId).liveBranch(updated)
+	if err != nil {
+		return err
+	}
+	if changes := branchProtectionChanges(desired, current); len(changes) > 0 {
+		return fmt.Errorf("%s were not changed: several access rules or rules for users, groups and deploy keys are not available on this instance, GitLab Premium is required", strings.Join(changes, ", "))
+	}
+	return nil
+}
+
+func UnprotectBranch(projectId int, name string, client *gitlab.Client) error {
+	_, err := client.ProtectedBranches.UnprotectRepositoryBranches(projectId, name)
+	return err
+}
+
+func planProtectedBranches(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if !manageProtectedBranches(project) {
+		return nil, nil
+	}
+	changes, err := protectedBranchChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importProtectedBranches(project *config.GitlabElement, projectId int) error {
+	branches, err := listProtectedBranches(projectId, gitlabClient)
+	if err != nil {
+		return err
+	}
+	resolver := newAccessResolver(gitlabClient, projectId)
+	for _, b := range branches {
+		protection, err := resolver.liveBranch(b)
+		if err != nil {
+			return err
+		}
+		project.ProtectedBranches = append(project.ProtectedBranches, protection.toConfig())
+	}
+	project.CleanUnmanagedBranches = len(branches) > 0
+	return nil
+}
+
+// protectedBranchRules reports protections which cannot be applied.
+// Protected branches are managed on projects only.
+func protectedBranchRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	if kind != projectKind {
+		if len(element.ProtectedBranches) > 0 {
+			issues = append(issues, validationIssue{Target: target, Field: "protected_branches", Message: "Protected branches are only supported on projects", Fatal: true})
+		}
+		return issues
+	}
+
+	seen := make(map[string]bool, len(element.ProtectedBranches))
+	for _, b := range element.ProtectedBranches {
+		field := "protected_branches." + b.Name
+		if seen[b.Name] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate protected branch", Fatal: true})
+		}
+		seen[b.Name] = true
+		for _, problem := range config.CheckProtectedBranch(b) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,449 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sheeva/config"
+	"strconv"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const protectedEnvironmentKind = "protected_environment"
+
+// apiProtectedEnvironment is a protected environment as returned by the API.
+// go-gitlab knows neither approval rules nor protections of groups.
+type apiProtectedEnvironment struct {
+	Name                  string                   `json:"name"`
+	DeployAccessLevels    []apiAccessLevel         `json:"deploy_access_levels"`
+	RequiredApprovalCount int                      `json:"required_approval_count"`
+	ApprovalRules         []apiEnvironmentApproval `json:"approval_rules"`
+}
+
+type apiEnvironmentApproval struct {
+	ID                int                     `json:"id"`
+	AccessLevel       gitlab.AccessLevelValue `json:"access_level"`
+	UserID            int                     `json:"user_id"`
+	GroupID           int                     `json:"group_id"`
+	RequiredApprovals int                     `json:"required_approvals"`
+}
+
+// environmentOwner is the project or group holding protected environments.
+type environmentOwner struct {
+	path      string
+	projectID int
+}
+
+func projectEnvironments(projectId int) environmentOwner {
+	return environmentOwner{path: fmt.Sprintf("projects/%d/protected_environments", projectId), projectID: projectId}
+}
+
+func groupEnvironments(groupID int) environmentOwner {
+	return environmentOwner{path: fmt.Sprintf("groups/%d/protected_environments", groupID)}
+}
+
+func (o environmentOwner) environmentPath(name string) string {
+	return o.path + "/" + url.PathEscape(name)
+}
+
+func listProtectedEnvironments(owner environmentOwner, client *gitlab.Client) ([]apiProtectedEnvironment, error) {
+	var environments []apiProtectedEnvironment
+	opts := &gitlab.ListOptions{PerPage: 100}
+	for {
+		req, err := client.NewRequest(http.MethodGet, owner.path, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []apiProtectedEnvironment
+		resp, err := client.Do(req, &page)
+		if err != nil {
+			return nil, err
+		}
+		environments = append(environments, page...)
+		if resp.NextPage == 0 {
+			return environments, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// defaultRequiredApprovals is what GitLab stores for an approval rule
+// without required_approvals.
+const defaultRequiredApprovals = 1
+
+// environmentApproval is an approval rule of a protected environment. Rules
+// are compared together with the number of approvals they require.
+type environmentApproval struct {
+	accessRule
+	Required int
+}
+
+func (a environmentApproval) key() string {
+	return a.accessRule.key() + ":" + strconv.Itoa(a.Required)
+}
+
+// environmentProtection is a protected environment with its rules resolved.
+type environmentProtection struct {
+	Name                  string
+	Deploy                []accessRule
+	RequiredApprovalCount int
+	Approvals             []environmentApproval
+}
+
+func (r *accessResolver) desiredEnvironment(e config.ProtectedEnv) (environmentProtection, error) {
+	protection := environmentProtection{Name: e.Name, RequiredApprovalCount: e.RequiredApprovalCount}
+	rules, err := r.desired(e.DeployAccessLevel, gitlab.MaintainerPermissions, e.AllowedToDeploy)
+	if err != nil {
+		return protection, err
+	}
+	// Unlike branches, environments deployable by users only have no role entry
+	for _, rule := range rules {
+		if rule.Kind != ruleAccessLevel || rule.Level != gitlab.NoPermissions {
+			protection.Deploy = append(protection.Deploy, rule)
+		}
+	}
+
+	for _, a := range e.ApprovalRules {
+		approval := environmentApproval{Required: a.RequiredApprovals}
+		if approval.Required == 0 {
+			approval.Required = defaultRequiredApprovals
+		}
+		var err error
+		switch {
+		case a.User != "":
+			approval.accessRule = accessRule{Kind: ruleUser, Name: a.User}
+			approval.RefID, err = lookupUserID(r.client, a.User)
+		case a.Group != "":
+			approval.accessRule = accessRule{Kind: ruleGroup, Name: a.Group}
+			approval.RefID, err = GetGroupID(a.Group, r.client)
+		default:
+			var level gitlab.AccessLevelValue
+			level, err = config.ParseProtectionLevel(a.AccessLevel)
+			approval.accessRule = accessRule{Kind: ruleAccessLevel, Name: config.ProtectionLevelName(level), Level: level}
+		}
+		if err != nil {
+			return protection, err
+		}
+		protection.Approvals = append(protection.Approvals, approval)
+	}
+	return protection, nil
+}
+
+func (r *accessResolver) liveEnvironment(e apiProtectedEnvironment) (environmentProtection, error) {
+	protection := environmentProtection{Name: e.Name, RequiredApprovalCount: e.RequiredApprovalCount}
+	var err error
+	if protection.Deploy, err = r.live(e.DeployAccessLevels, gitlab.MaintainerPermissions); err != nil {
+		return protection, err
+	}
+	for _, a := range e.ApprovalRules {
+		rules, err := r.live([]apiAccessLevel{{ID: a.ID, AccessLevel: a.AccessLevel, UserID: a.UserID, GroupID: a.GroupID}}, gitlab.MaintainerPermissions)
+		if err != nil {
+			return protection, err
+		}
+		protection.Approvals = append(protection.Approvals, environmentApproval{accessRule: rules[0], Required: a.RequiredApprovals})
+	}
+	return protection, nil
+}
+
+func (e environmentProtection) toConfig() config.ProtectedEnv {
+	env := config.ProtectedEnv{Name: e.Name, RequiredApprovalCount: e.RequiredApprovalCount}
+	env.DeployAccessLevel, env.AllowedToDeploy = accessConfig(e.Deploy)
+	for _, a := range e.Approvals {
+		rule := config.EnvironmentApprovalRule{RequiredApprovals: a.Required}
+		switch a.Kind {
+		case ruleUser:
+			rule.User = a.Name
+		case ruleGroup:
+			rule.Group = a.Name
+		default:
+			rule.AccessLevel = a.Name
+		}
+		env.ApprovalRules = append(env.ApprovalRules, rule)
+	}
+	return env
+}
+
+func sameApprovals(desired, live []environmentApproval) bool {
+	if len(desired) != len(live) {
+		return false
+	}
+	keys := make(map[string]bool, len(live))
+	for _, a := range live {
+		keys[a.key()] = true
+	}
+	for _, a := range desired {
+		if !keys[a.key()] {
+			return false
+		}
+	}
+	return true
+}
+
+func environmentProtectionChanges(desired, live environmentProtection) []string {
+	var changes []string
+	if !sameAccessRules(desired.Deploy, live.Deploy) {
+		changes = append(changes, "deploy_access_levels")
+	}
+	if desired.RequiredApprovalCount != live.RequiredApprovalCount {
+		changes = append(changes, "required_approval_count")
+	}
+	if !sameApprovals(desired.Approvals, live.Approvals) {
+		changes = append(changes, "approval_rules")
+	}
+	return changes
+}
+
+// environmentProtectionChange is a planned change together with both
+// protections.
+type environmentProtectionChange struct {
+	plannedChange
+	Desired environmentProtection
+	Live    environmentProtection
+}
+
+// canUpdateEnvironmentProtections reports whether GitLab can change an
+// existing environment protection. Older versions need it to be recreated.
+func canUpdateEnvironmentProtections() bool {
+	return gitlabVersion().AtLeast(15, 4)
+}
+
+// protectedEnvironmentChanges compares the protected environments with the
+// live ones by name.
+func protectedEnvironmentChanges(owner environmentOwner, element config.GitlabElement, client *gitlab.Client) ([]environmentProtectionChange, error) {
+	target := elementPath(element)
+	resolver := newAccessResolver(client, owner.projectID)
+
+	apiEnvironments, err := listProtectedEnvironments(owner, client)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]environmentProtection, len(apiEnvironments))
+	for _, e := range apiEnvironments {
+		if live[e.Name], err = resolver.liveEnvironment(e); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []environmentProtectionChange
+	desiredNames := make(map[string]bool, len(element.ProtectedEnvironments))
+	for _, e := range element.ProtectedEnvironments {
+		desiredNames[e.Name] = true
+		desired, err := resolver.desiredEnvironment(e)
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":       err,
+				"Target":      target,
+				"Environment": e.Name,
+			}).Error("Error while resolving protected environment")
+			continue
+		}
+
+		change := environmentProtectionChange{
+			plannedChange: plannedChange{Kind: protectedEnvironmentKind, Target: target, Name: e.Name},
+			Desired:       desired,
+		}
+		current, ok := live[e.Name]
+		if !ok {
+			change.Action = actionCreate
+			changes = append(changes, change)
+			continue
+		}
+		if change.Changes = environmentProtectionChanges(desired, current); len(change.Changes) == 0 {
+			continue
+		}
+		change.Action, change.Live = actionReplace, current
+		if canUpdateEnvironmentProtections() {
+			change.Action = actionUpdate
+		}
+		changes = append(changes, change)
+	}
+
+	if element.CleanProtectedEnvs {
+		for _, e := range apiEnvironments {
+			if !desiredNames[e.Name] {
+				changes = append(changes, environmentProtectionChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: protectedEnvironmentKind, Target: target, Name: e.Name},
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// environmentApprovalPermission is an entry of approval_rules. Entries with
+// Destroy set remove an existing rule when a protection is updated.
+type environmentApprovalPermission struct {
+	ID                *int                     `url:"id,omitempty" json:"id,omitempty"`
+	UserID            *int                     `url:"user_id,omitempty" json:"user_id,omitempty"`
+	GroupID           *int                     `url:"group_id,omitempty" json:"group_id,omitempty"`
+	AccessLevel       *gitlab.AccessLevelValue `url:"access_level,omitempty" json:"access_level,omitempty"`
+	RequiredApprovals *int                     `url:"required_approvals,omitempty" json:"required_approvals,omitempty"`
+	Destroy           *bool                    `url:"_destroy,omitempty" json:"_destroy,omitempty"`
+}
+
+func newApprovalPermission(a environmentApproval) *environmentApprovalPermission {
+	p := newAccessPermission(a.accessRule)
+	return &environmentApprovalPermission{
+		UserID:            p.UserID,
+		GroupID:           p.GroupID,
+		AccessLevel:       p.AccessLevel,
+		RequiredApprovals: gitlab.Int(a.Required),
+	}
+}
+
+// approvalPermissionUpdates lists the entries turning the live approval
+// rules into the desired ones. A rule requiring another number of approvals
+// is removed and added again.
+func approvalPermissionUpdates(desired, live []environmentApproval) []*environmentApprovalPermission {
+	liveKeys := make(map[string]bool, len(live))
+	for _, a := range live {
+		liveKeys[a.key()] = true
+	}
+	desiredKeys := make(map[string]bool, len(desired))
+	var permissions []*environmentApprovalPermission
+	for _, a := range desired {
+		desiredKeys[a.key()] = true
+		if !liveKeys[a.key()] {
+			permissions = append(permissions, newApprovalPermission(a))
+		}
+	}
+	for _, a := range live {
+		if !desiredKeys[a.key()] {
+			permissions = append(permissions, &environmentApprovalPermission{ID: gitlab.Int(a.EntryID), Destroy: gitlab.Bool(true)})
+		}
+	}
+	return permissions
+}
+
+type protectEnvironmentRequest struct {
+	Name                  *string                          `url:"name,omitempty" json:"name,omitempty"`
+	DeployAccessLevels    []*accessPermission              `url:"deploy_access_levels,omitempty" json:"deploy_access_levels,omitempty"`
+	RequiredApprovalCount *int                             `url:"required_approval_count,omitempty" json:"required_approval_count,omitempty"`
+	ApprovalRules         []*environmentApprovalPermission `url:"approval_rules,omitempty" json:"approval_rules,omitempty"`
+}
+
+func ProtectEnvironment(owner environmentOwner, e environmentProtection, client *gitlab.Client) error {
+	opt := protectEnvironmentRequest{
+		Name:               gitlab.String(e.Name),
+		DeployAccessLevels: accessPermissions(e.Deploy),
+	}
+	if e.RequiredApprovalCount > 0 {
+		opt.RequiredApprovalCount = gitlab.Int(e.RequiredApprovalCount)
+	}
+	for _, a := range e.Approvals {
+		opt.ApprovalRules = append(opt.ApprovalRules, newApprovalPermission(a))
+	}
+	return doRequest(client, http.MethodPost, owner.path, opt)
+}
+
+func UpdateProtectedEnvironment(owner environmentOwner, desired, live environmentProtection, client *gitlab.Client) error {
+	opt := protectEnvironmentRequest{
+		DeployAccessLevels: accessPermissionUpdates(desired.Deploy, live.Deploy),
+		ApprovalRules:      approvalPermissionUpdates(desired.Approvals, live.Approvals),
+	}
+	if desired.RequiredApprovalCount != live.RequiredApprovalCount {
+		opt.RequiredApprovalCount = gitlab.Int(desired.RequiredApprovalCount)
+	}
+	return doRequest(client, http.MethodPut, owner.environmentPath(desired.Name), opt)
+}
+
+func UnprotectEnvironment(owner environmentOwner, name string, client *gitlab.Client) error {
+	return doRequest(client, http.MethodDelete, owner.environmentPath(name), nil)
+}
+
+func manageProtectedEnvironments(element config.GitlabElement) bool {
+	return len(element.ProtectedEnvironments) > 0 || element.CleanProtectedEnvs
+}
+
+func applyProtectedEnvironments(fields logger.Fields, owner environmentOwner, element config.GitlabElement, client *gitlab.Client) error {
+	if !manageProtectedEnvironments(element) {
+		return nil
+	}
+	changes, err := protectedEnvironmentChanges(owner, element, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = ProtectEnvironment(owner, change.Desired, client)
+		case actionUpdate:
+			err = UpdateProtectedEnvironment(owner, change.Desired, change.Live, client)
+		case actionReplace:
+			if err = UnprotectEnvironment(owner, change.Name, client); err == nil {
+				err = ProtectEnvironment(owner, change.Desired, client)
+			}
+		case actionDelete:
+			err = UnprotectEnvironment(owner, change.Name, client)
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":       err,
+				"Action":      change.Action,
+				"Environment": change.Name,
+			}).Warning("Error ocured while changing protected environment")
+		}
+	}
+	return nil
+}
+
+func planProtectedEnvironments(owner environmentOwner, element config.GitlabElement) ([]plannedChange, error) {
+	if !manageProtectedEnvironments(element) {
+		return nil, nil
+	}
+	changes, err := protectedEnvironmentChanges(owner, element, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+// importProtectedEnvironments skips protected environments when they are
+// not available, they need GitLab Premium.
+func importProtectedEnvironments(owner environmentOwner, element *config.GitlabElement) error {
+	environments, err := listProtectedEnvironments(owner, gitlabClient)
+	if isUnavailable(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resolver := newAccessResolver(gitlabClient, owner.projectID)
+	for _, e := range environments {
+		protection, err := resolver.liveEnvironment(e)
+		if err != nil {
+			return err
+		}
+		element.ProtectedEnvironments = append(element.ProtectedEnvironments, protection.toConfig())
+	}
+	element.CleanProtectedEnvs = len(environments) > 0
+	return nil
+}
+
+func ManageProjectProtectedEnvironments(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	return applyProtectedEnvironments(logger.Fields{"Project": elementPath(project)}, projectEnvironments(projectId), project, client)
+}
+
+func ManageGroupProtectedEnvironments(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	return applyProtectedEnvironments(logger.Fields{"Group": elementPath(group)}, groupEnvironments(groupID), group, client)
+}
+
+func planProjectProtectedEnvironments(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	return planProtectedEnvironments(projectEnvironments(projectId), project)
+}
+
+func planGroupProtectedEnvironments(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	return planProtectedEnvironments(groupEnvironments(groupID), group)
+}
+
+func importProjectProtectedEnvironments(project *config.GitlabElement, projectId int) error {
+	return importProtectedEnvironments(projectEnvironments(projectId), project)
+}
+
+func importGroupProtectedEnvironments(group *config.GitlabElement, groupID int) error {
+	return importProtectedEnvironments(groupEnvironments(groupID), group)
+}
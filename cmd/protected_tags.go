@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const protectedTagKind = "protected_tag"
+
+// apiProtectedTag is a protected tag as returned by the API.
+type apiProtectedTag struct {
+	Name               string           `json:"name"`
+	CreateAccessLevels []apiAccessLevel `json:"create_access_levels"`
+}
+
+func listProtectedTags(projectId int, client *gitlab.Client) ([]apiProtectedTag, error) {
+	var tags []apiProtectedTag
+	opts := &gitlab.ListOptions{PerPage: 100}
+	for {
+		req, err := client.NewRequest(http.MethodGet, fmt.Sprintf("projects/%d/protected_tags", projectId), opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []apiProtectedTag
+		resp, err := client.Do(req, &page)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		if resp.NextPage == 0 {
+			return tags, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// tagProtection is a protected tag with its access rules resolved.
+type tagProtection struct {
+	Name   string
+	Create []accessRule
+}
+
+func (t tagProtection) toConfig() config.ProtectedTag {
+	tag := config.ProtectedTag{Name: t.Name}
+	tag.CreateAccessLevel, tag.AllowedToCreate = accessConfig(t.Create)
+	return tag
+}
+
+// tagChange is a planned change together with the desired protection.
+type tagChange struct {
+	plannedChange
+	Desired tagProtection
+}
+
+// protectedTagChanges compares the protected tags of the project with the
+// live ones. GitLab cannot edit a tag protection, so changed ones are
+// replaced.
+func protectedTagChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]tagChange, error) {
+	target := elementPath(project)
+	resolver := newAccessResolver(client, projectId)
+
+	apiTags, err := listProtectedTags(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]tagProtection, len(apiTags))
+	for _, t := range apiTags {
+		rules, err := resolver.live(t.CreateAccessLevels, gitlab.MaintainerPermissions)
+		if err != nil {
+			return nil, err
+		}
+		live[t.Name] = tagProtection{Name: t.Name, Create: rules}
+	}
+
+	var changes []tagChange
+	desiredNames := make(map[string]bool, len(project.ProtectedTags))
+	for _, t := range project.ProtectedTags {
+		desiredNames[t.Name] = true
+		rules, err := resolver.desired(t.CreateAccessLevel, gitlab.MaintainerPermissions, t.AllowedToCreate)
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": target,
+				"Tag":     t.Name,
+			}).Error("Error while resolving protected tag")
+			continue
+		}
+		desired := tagProtection{Name: t.Name, Create: rules}
+
+		current, ok := live[t.Name]
+		switch {
+		case !ok:
+			changes = append(changes, tagChange{
+				plannedChange: plannedChange{Action: actionCreate, Kind: protectedTagKind, Target: target, Name: t.Name},
+				Desired:       desired,
+			})
+		case !sameAccessRules(desired.Create, current.Create):
+			changes = append(changes, tagChange{
+				plannedChange: plannedChange{Action: actionReplace, Kind: protectedTagKind, Target: target, Name: t.Name, Changes: []string{"create_access_levels"}},
+				Desired:       desired,
+			})
+		}
+	}
+
+	if project.CleanUnmanagedTags {
+		for _, t := range apiTags {
+			if !desiredNames[t.Name] {
+				changes = append(changes, tagChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: protectedTagKind, Target: target, Name: t.Name},
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+func manageProtectedTags(project config.GitlabElement) bool {
+	return len(project.ProtectedTags) > 0 || project.CleanUnmanagedTags
+}
+
+func ManageProtectedTags(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if !manageProtectedTags(project) {
+		return nil
+	}
+	changes, err := protectedTagChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = ProtectTag(projectId, change.Desired, client)
+		case actionReplace:
+			if err = UnprotectTag(projectId, change.Name, client); err == nil {
+				err = ProtectTag(projectId, change.Desired, client)
+			}
+		case actionDelete:
+			err = UnprotectTag(projectId, change.Name, client)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{
+				"Error":   err,
+				"Project": elementPath(project),
+				"Action":  change.Action,
+				"Tag":     change.Name,
+			}).Warning("Error ocured while changing protected tag")
+		}
+	}
+	return nil
+}
+
+type protectTagRequest struct {
+	Name              *string                  `url:"name,omitempty" json:"name,omitempty"`
+	CreateAccessLevel *gitlab.AccessLevelValue `url:"create_access_level,omitempty" json:"create_access_level,omitempty"`
+	AllowedToCreate   []*accessPermission      `url:"allowed_to_create,omitempty" json:"allowed_to_create,omitempty"`
+}
+
+func ProtectTag(projectId int, t tagProtection, client *gitlab.Client) error {
+	opt := protectTagRequest{Name: gitlab.String(t.Name)}
+	opt.CreateAccessLevel, opt.AllowedToCreate = splitAccessRules(t.Create)
+	return doRequest(client, http.MethodPost, fmt.Sprintf("projects/%d/protected_tags", projectId), opt)
+}
+
+func UnprotectTag(projectId int, name string, client *gitlab.Client) error {
+	_, err := client.ProtectedTags.UnprotectRepositoryTags(projectId, name)
+	return err
+}
+
+func planProtectedTags(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if !manageProtectedTags(project) {
+		return nil, nil
+	}
+	changes, err := protectedTagChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importProtectedTags(project *config.GitlabElement, projectId int) error {
+	tags, err := listProtectedTags(projectId, gitlabClient)
+	if err != nil {
+		return err
+	}
+	resolver := newAccessResolver(gitlabClient, projectId)
+	for _, t := range tags {
+		rules, err := resolver.live(t.CreateAccessLevels, gitlab.MaintainerPermissions)
+		if err != nil {
+			return err
+		}
+		project.ProtectedTags = append(project.ProtectedTags, tagProtection{Name: t.Name, Create: rules}.toConfig())
+	}
+	project.CleanUnmanagedTags = len(tags) > 0
+	return nil
+}
+
+// protectedTagRules reports tag protections which cannot be applied.
+// Protected tags are managed on projects only.
+func protectedTagRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	if kind != projectKind {
+		if len(element.ProtectedTags) > 0 {
+			issues = append(issues, validationIssue{Target: target, Field: "protected_tags", Message: "Protected tags are only supported on projects", Fatal: true})
+		}
+		return issues
+	}
+
+	seen := make(map[string]bool, len(element.ProtectedTags))
+	for _, t := range element.ProtectedTags {
+		field := "protected_tags." + t.Name
+		if seen[t.Name] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate protected tag", Fatal: true})
+		}
+		seen[t.Name] = true
+		for _, problem := range config.CheckProtectedTag(t) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const pushRulesKind = "push_rules"
+
+// pushRuleChanges lists the attributes of the push rules which differ.
+func pushRuleChanges(desired, live config.PushRules) []string {
+	var changes []string
+	attributes := []struct {
+		name          string
+		desired, live interface{}
+	}{
+		{"commit_message_regex", desired.CommitMessageRegex, live.CommitMessageRegex},
+		{"commit_message_negative_regex", desired.CommitMessageNegativeRegex, live.CommitMessageNegativeRegex},
+		{"branch_name_regex", desired.BranchNameRegex, live.BranchNameRegex},
+		{"author_email_regex", desired.AuthorEmailRegex, live.AuthorEmailRegex},
+		{"file_name_regex", desired.FileNameRegex, live.FileNameRegex},
+		{"max_file_size", desired.MaxFileSize, live.MaxFileSize},
+		{"deny_delete_tag", desired.DenyDeleteTag, live.DenyDeleteTag},
+		{"prevent_secrets", desired.PreventSecrets, live.PreventSecrets},
+		{"member_check", desired.MemberCheck, live.MemberCheck},
+		{"commit_committer_check", desired.CommitCommitterCheck, live.CommitCommitterCheck},
+		{"reject_unsigned_commits", desired.RejectUnsignedCommits, live.RejectUnsignedCommits},
+	}
+	for _, a := range attributes {
+		if a.desired != a.live {
+			changes = append(changes, a.name)
+		}
+	}
+	return changes
+}
+
+// pushRuleChange is a planned change together with the desired push rules.
+type pushRuleChange struct {
+	plannedChange
+	Rules config.PushRules
+}
+
+// diffPushRules compares the desired push rules with the live ones, live is
+// nil when there are none.
+func diffPushRules(target string, desired config.PushRules, live *config.PushRules) []pushRuleChange {
+	switch {
+	case desired.Absent() && live == nil:
+		return nil
+	case desired.Absent():
+		return []pushRuleChange{{plannedChange: plannedChange{Action: actionDelete, Kind: pushRulesKind, Target: target}}}
+	case live == nil:
+		return []pushRuleChange{{plannedChange: plannedChange{Action: actionCreate, Kind: pushRulesKind, Target: target}, Rules: desired}}
+	}
+	if attributes := pushRuleChanges(desired, *live); len(attributes) > 0 {
+		return []pushRuleChange{{plannedChange: plannedChange{Action: actionUpdate, Kind: pushRulesKind, Target: target, Changes: attributes}, Rules: desired}}
+	}
+	return nil
+}
+
+// pushRuleClient holds the push rule calls of a project or a group. Both
+// are read from path, which returns the same attributes.
+type pushRuleClient struct {
+	client *gitlab.Client
+	path   string
+	add    func(config.PushRules) error
+	edit   func(config.PushRules) error
+	remove func() error
+}
+
+// premiumRequired explains errors of instances without push rules, which
+// need GitLab Premium.
+func premiumRequired(feature string, err error) error {
+	if isUnavailable(err) {
+		return fmt.Errorf("%s are not available on this instance, GitLab Premium is required: %w", feature, err)
+	}
+	return err
+}
+
+// get returns nil when no push rules are set.
+func (c pushRuleClient) get() (*config.PushRules, error) {
+	req, err := c.client.NewRequest(http.MethodGet, c.path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var live gitlab.GroupPushRules
+	if _, err := c.client.Do(req, &live); err != nil || live.ID == 0 {
+		return nil, err
+	}
+	return &config.PushRules{
+		CommitMessageRegex:         live.CommitMessageRegex,
+		CommitMessageNegativeRegex: live.CommitMessageNegativeRegex,
+		BranchNameRegex:            live.BranchNameRegex,
+		AuthorEmailRegex:           live.AuthorEmailRegex,
+		FileNameRegex:              live.FileNameRegex,
+		MaxFileSize:                live.MaxFileSize,
+		DenyDeleteTag:              live.DenyDeleteTag,
+		PreventSecrets:             live.PreventSecrets,
+		MemberCheck:                live.MemberCheck,
+		CommitCommitterCheck:       live.CommitCommitterCheck,
+		RejectUnsignedCommits:      live.RejectUnsignedCommits,
+	}, nil
+}
+
+func (c pushRuleClient) changes(element config.GitlabElement) ([]pushRuleChange, error) {
+	live, err := c.get()
+	if err != nil {
+		return nil, premiumRequired("push rules", err)
+	}
+	return diffPushRules(elementPath(element), *element.PushRules, live), nil
+}
+
+func (c pushRuleClient) manage(fields logger.Fields, element config.GitlabElement) error {
+	if element.PushRules == nil {
+		return nil
+	}
+	changes, err := c.changes(element)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = c.add(change.Rules)
+		case actionUpdate:
+			err = c.edit(change.Rules)
+		case actionDelete:
+			err = c.remove()
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":  premiumRequired("push rules", err),
+				"Action": change.Action,
+			}).Warning("Error ocured while changing push rules")
+		}
+	}
+	return nil
+}
+
+func (c pushRuleClient) plan(element config.GitlabElement) ([]plannedChange, error) {
+	if element.PushRules == nil {
+		return nil, nil
+	}
+	changes, err := c.changes(element)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func projectPushRuleClient(projectId int, client *gitlab.Client) pushRuleClient {
+	return pushRuleClient{
+		client: client,
+		path:   fmt.Sprintf("projects/%d/push_rule", projectId),
+		add: func(r config.PushRules) error {
+			opt := gitlab.AddProjectPushRuleOptions(pushRuleOptions(r))
+			_, _, err := client.Projects.AddProjectPushRule(projectId, &opt)
+			return err
+		},
+		edit: func(r config.PushRules) error {
+			opt := gitlab.EditProjectPushRuleOptions(pushRuleOptions(r))
+			_, _, err := client.Projects.EditProjectPushRule(projectId, &opt)
+			return err
+		},
+		remove: func() error {
+			_, err := client.Projects.DeleteProjectPushRule(projectId)
+			return err
+		},
+	}
+}
+
+func groupPushRuleClient(groupID int, client *gitlab.Client) pushRuleClient {
+	return pushRuleClient{
+		client: client,
+		path:   fmt.Sprintf("groups/%d/push_rule", groupID),
+		add: func(r config.PushRules) error {
+			opt := gitlab.AddGroupPushRuleOptions(pushRuleOptions(r))
+			_, _, err := client.Groups.AddGroupPushRule(groupID, &opt)
+			return err
+		},
+		edit: func(r config.PushRules) error {
+			opt := gitlab.EditGroupPushRuleOptions(pushRuleOptions(r))
+			_, _, err := client.Groups.EditGroupPushRule(groupID, &opt)
+			return err
+		},
+		remove: func() error {
+			_, err := client.Groups.DeleteGroupPushRule(groupID)
+			return err
+		},
+	}
+}
+
+// pushRuleOptions sends every attribute, so settings left out of the YAML
+// are turned off.
+func pushRuleOptions(r config.PushRules) gitlab.AddProjectPushRuleOptions {
+	return gitlab.AddProjectPushRuleOptions{
+		CommitMessageRegex:         gitlab.String(r.CommitMessageRegex),
+		CommitMessageNegativeRegex: gitlab.String(r.CommitMessageNegativeRegex),
+		BranchNameRegex:            gitlab.String(r.BranchNameRegex),
+		AuthorEmailRegex:           gitlab.String(r.AuthorEmailRegex),
+		FileNameRegex:              gitlab.String(r.FileNameRegex),
+		MaxFileSize:                gitlab.Int(r.MaxFileSize),
+		DenyDeleteTag:              gitlab.Bool(r.DenyDeleteTag),
+		PreventSecrets:             gitlab.Bool(r.PreventSecrets),
+		MemberCheck:                gitlab.Bool(r.MemberCheck),
+		CommitCommitterCheck:       gitlab.Bool(r.CommitCommitterCheck),
+		RejectUnsignedCommits:      gitlab.Bool(r.RejectUnsignedCommits),
+	}
+}
+
+func ManageProjectPushRules(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	return projectPushRuleClient(projectId, client).manage(logger.Fields{"Project": elementPath(project)}, project)
+}
+
+func ManageGroupPushRules(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	return groupPushRuleClient(groupID, client).manage(logger.Fields{"Group": elementPath(group)}, group)
+}
+
+func planProjectPushRules(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	return projectPushRuleClient(projectId, gitlabClient).plan(project)
+}
+
+func planGroupPushRules(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	return groupPushRuleClient(groupID, gitlabClient).plan(group)
+}
+
+// importPushRules skips push rules on instances without them, so GitLab
+// Free can still be imported.
+func importPushRules(element *config.GitlabElement, c pushRuleClient) error {
+	live, err := c.get()
+	if isUnavailable(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	element.PushRules = live
+	return nil
+}
+
+func importProjectPushRules(project *config.GitlabElement, projectId int) error {
+	return importPushRules(project, projectPushRuleClient(projectId, gitlabClient))
+}
+
+func importGroupPushRules(group *config.GitlabElement, groupID int) error {
+	return importPushRules(group, groupPushRuleClient(groupID, gitlabClient))
+}
+
+func pushRuleRules(kind string, element config.GitlabElement) []validationIssue {
+	if element.PushRules == nil {
+		return nil
+	}
+	target := elementPath(element)
+	var issues []validationIssue
+	for _, problem := range config.CheckPushRules(*element.PushRules) {
+		issues = append(issues, validationIssue{Target: target, Field: "push_rules", Message: problem, Fatal: true})
+	}
+	return issues
+}
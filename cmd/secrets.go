@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const defaultEditor = "vi"
+
+// EditSecretFile decrypts filePath into a temporary file, opens it in $EDITOR
+// and encrypts the result back with the same keys.
+func EditSecretFile(filePath string) error {
+	secret, err := config.OpenSecretFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "sheeva-*"+filepath.Ext(strings.TrimSuffix(filePath, ".age")))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(secret.Plaintext); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := runEditor(tmp.Name()); err != nil {
+		return err
+	}
+
+	edited, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, secret.Plaintext) {
+		logger.WithField("File", filePath).Info("File has not changed")
+		return nil
+	}
+
+	sealed, err := secret.Seal(edited)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filePath, sealed, 0600); err != nil {
+		return err
+	}
+
+	logger.WithFields(logger.Fields{
+		"File":      filePath,
+		"Encrypted": secret.Encrypted(),
+	}).Info("Secret file successfully saved")
+	return nil
+}
+
+func runEditor(file string) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = defaultEditor
+	}
+
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], file)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
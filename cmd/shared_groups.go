@@ -0,0 +1,259 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// liveShare is a group the project or group is shared with.
+type liveShare struct {
+	GroupID     int
+	Group       string
+	AccessLevel gitlab.AccessLevelValue
+	ExpiresAt   string
+}
+
+// apiSharedGroups is the part of a project or group returned by the API
+// which lists its shares. go-gitlab leaves out the expiry date of project
+// shares, so it is decoded here.
+type apiSharedGroups struct {
+	SharedWithGroups []struct {
+		GroupID          int             `json:"group_id"`
+		GroupFullPath    string          `json:"group_full_path"`
+		GroupAccessLevel int             `json:"group_access_level"`
+		ExpiresAt        *gitlab.ISOTime `json:"expires_at"`
+	} `json:"shared_with_groups"`
+}
+
+func listSharedGroups(client *gitlab.Client, path string, opt interface{}) ([]liveShare, error) {
+	req, err := client.NewRequest(http.MethodGet, path, opt, nil)
+	if err != nil {
+		return nil, err
+	}
+	var shared apiSharedGroups
+	if _, err := client.Do(req, &shared); err != nil {
+		return nil, err
+	}
+
+	var shares []liveShare
+	for _, s := range shared.SharedWithGroups {
+		shares = append(shares, liveShare{
+			GroupID:     s.GroupID,
+			Group:       s.GroupFullPath,
+			AccessLevel: gitlab.AccessLevelValue(s.GroupAccessLevel),
+			ExpiresAt:   isoDate(s.ExpiresAt),
+		})
+	}
+	return shares, nil
+}
+
+// shareChange is a planned change together with what the API needs to apply
+// it.
+type shareChange struct {
+	plannedChange
+	GroupID     int
+	AccessLevel gitlab.AccessLevelValue
+	ExpiresAt   string
+}
+
+// diffSharedGroups compares desired shares with the live ones. GitLab cannot
+// edit a share, so changed shares are replaced.
+func diffSharedGroups(client *gitlab.Client, target string, desired []config.SharedGroup, live []liveShare, clean bool) []shareChange {
+	fields := logger.Fields{"Target": target}
+	liveByPath := make(map[string]liveShare, len(live))
+	for _, s := range live {
+		liveByPath[strings.ToLower(s.Group)] = s
+	}
+
+	var changes []shareChange
+	desiredPaths := make(map[string]bool, len(desired))
+	for _, s := range desired {
+		// A rejected share is still declared and must not be removed
+		path := strings.ToLower(s.Group)
+		desiredPaths[path] = true
+
+		if problems := config.CheckSharedGroup(s); len(problems) > 0 {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Problems":    strings.Join(problems, "; "),
+				"SharedGroup": s.Group,
+			}).Error("Shared group rejected by local validation")
+			continue
+		}
+		level, _ := config.ParseAccessLevel(s.AccessLevel)
+
+		current, ok := liveByPath[path]
+		if !ok {
+			groupID, err := GetGroupID(s.Group, client)
+			if err != nil {
+				logger.WithFields(fields).WithFields(logger.Fields{
+					"Error":       err,
+					"SharedGroup": s.Group,
+				}).Error("Error while resolving shared group")
+				continue
+			}
+			changes = append(changes, shareChange{
+				plannedChange: plannedChange{Action: actionCreate, Kind: "shared_group", Target: target, Name: s.Group},
+				GroupID:       groupID,
+				AccessLevel:   level,
+				ExpiresAt:     s.ExpiresAt,
+			})
+			continue
+		}
+		if attributes := memberAttributeChanges(level, s.ExpiresAt, liveMember{AccessLevel: current.AccessLevel, ExpiresAt: current.ExpiresAt}); len(attributes) > 0 {
+			changes = append(changes, shareChange{
+				plannedChange: plannedChange{Action: actionReplace, Kind: "shared_group", Target: target, Name: current.Group, Changes: attributes},
+				GroupID:       current.GroupID,
+				AccessLevel:   level,
+				ExpiresAt:     s.ExpiresAt,
+			})
+		}
+	}
+
+	if clean {
+		for _, s := range live {
+			if !desiredPaths[strings.ToLower(s.Group)] {
+				changes = append(changes, shareChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: "shared_group", Target: target, Name: s.Group},
+					GroupID:       s.GroupID,
+				})
+			}
+		}
+	}
+	return changes
+}
+
+// shareClient shares one project or group with other groups.
+type shareClient struct {
+	share   func(shareChange) error
+	unshare func(shareChange) error
+}
+
+func (c shareClient) apply(fields logger.Fields, changes []shareChange) {
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = c.share(change)
+		case actionReplace:
+			if err = c.unshare(change); err == nil {
+				err = c.share(change)
+			}
+		case actionDelete:
+			err = c.unshare(change)
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":       err,
+				"Action":      change.Action,
+				"SharedGroup": change.Name,
+			}).Warning("Error ocured while changing shared group")
+		}
+	}
+}
+
+func manageSharedGroups(element config.GitlabElement) bool {
+	return len(element.SharedWithGroups) > 0 || element.CleanUnmanagedShares
+}
+
+func ManageProjectSharedGroups(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if !manageSharedGroups(project) {
+		return nil
+	}
+	changes, err := projectShareChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	shareClient{
+		share: func(c shareChange) error {
+			_, err := client.Projects.ShareProjectWithGroup(projectId, &gitlab.ShareWithGroupOptions{
+				GroupID:     gitlab.Int(c.GroupID),
+				GroupAccess: gitlab.AccessLevel(c.AccessLevel),
+				ExpiresAt:   expiresAt(c.ExpiresAt),
+			})
+			return err
+		},
+		unshare: func(c shareChange) error {
+			_, err := client.Projects.DeleteSharedProjectFromGroup(projectId, c.GroupID)
+			return err
+		},
+	}.apply(logger.Fields{"Project": elementPath(project)}, changes)
+	return nil
+}
+
+func ManageGroupSharedGroups(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	if !manageSharedGroups(group) {
+		return nil
+	}
+	changes, err := groupShareChanges(groupID, group, client)
+	if err != nil {
+		return err
+	}
+
+	shareClient{
+		share: func(c shareChange) error {
+			opt := &gitlab.ShareGroupWithGroupOptions{
+				GroupID:     gitlab.Int(c.GroupID),
+				GroupAccess: gitlab.AccessLevel(c.AccessLevel),
+			}
+			if c.ExpiresAt != "" {
+				date, err := config.ParseDate(c.ExpiresAt)
+				if err != nil {
+					return err
+				}
+				expires := gitlab.ISOTime(date)
+				opt.ExpiresAt = &expires
+			}
+			_, _, err := client.Groups.ShareGroupWithGroup(groupID, opt)
+			return err
+		},
+		unshare: func(c shareChange) error {
+			_, err := client.Groups.UnshareGroupFromGroup(groupID, c.GroupID)
+			return err
+		},
+	}.apply(logger.Fields{"Group": elementPath(group)}, changes)
+	return nil
+}
+
+func projectShareChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]shareChange, error) {
+	live, err := listSharedGroups(client, fmt.Sprintf("projects/%d", projectId), nil)
+	if err != nil {
+		return nil, err
+	}
+	return diffSharedGroups(client, elementPath(project), project.SharedWithGroups, live, project.CleanUnmanagedShares), nil
+}
+
+func groupShareChanges(groupID int, group config.GitlabElement, client *gitlab.Client) ([]shareChange, error) {
+	live, err := listSharedGroups(client, fmt.Sprintf("groups/%d", groupID), &gitlab.GetGroupOptions{WithProjects: gitlab.Bool(false)})
+	if err != nil {
+		return nil, err
+	}
+	return diffSharedGroups(client, elementPath(group), group.SharedWithGroups, live, group.CleanUnmanagedShares), nil
+}
+
+func planProjectSharedGroups(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if !manageSharedGroups(project) {
+		return nil, nil
+	}
+	changes, err := projectShareChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func planGroupSharedGroups(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	if !manageSharedGroups(group) {
+		return nil, nil
+	}
+	changes, err := groupShareChanges(groupID, group, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
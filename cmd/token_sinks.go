@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// storeToken writes the value of a new token to its sink. name defaults the
+// key in an encrypted file. The value is never logged.
+func storeToken(name string, sink *config.TokenSink, value string, client *gitlab.Client) error {
+	switch {
+	case sink == nil:
+		return fmt.Errorf("token '%s' has no sink, its value is lost", name)
+	case sink.Variable != nil:
+		return storeTokenVariable(*sink.Variable, value, client)
+	case sink.File != "":
+		return storeTokenFile(sink.File, value)
+	default:
+		key := sink.Key
+		if key == "" {
+			key = name
+		}
+		return storeEncryptedToken(sink.EncryptedFile, key, value)
+	}
+}
+
+func sinkVariable(sink config.SinkVariable, value string) config.Variable {
+	return normalizeVariable(config.Variable{
+		Key:          sink.Key,
+		Value:        value,
+		VariableType: "env_var",
+		Protected:    sink.Protected,
+		Masked:       sink.Masked,
+		Raw:          true,
+		Environment:  sink.Environment,
+	})
+}
+
+// storeTokenVariable creates or updates the variable, so the token can be
+// rotated in place.
+func storeTokenVariable(sink config.SinkVariable, value string, client *gitlab.Client) error {
+	variable := sinkVariable(sink, value)
+	exists := func(live []config.Variable) bool {
+		for _, v := range live {
+			if config.VariableID(v) == config.VariableID(variable) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if sink.Project != "" {
+		projectId, err := GetProjectId(sink.Project, client)
+		if err != nil {
+			return err
+		}
+		live, err := listProjectVariables(projectId, client)
+		if err != nil {
+			return err
+		}
+		if exists(live) {
+			return UpdateProjectVariable(projectId, variable, client)
+		}
+		return CreateProjectVariable(projectId, variable, client)
+	}
+
+	groupID, err := GetGroupID(sink.Group, client)
+	if err != nil {
+		return err
+	}
+	live, err := listGroupVariables(groupID, client)
+	if err != nil {
+		return err
+	}
+	if exists(live) {
+		return UpdateGroupVariable(groupID, variable, client)
+	}
+	return CreateGroupVariable(groupID, variable, client)
+}
+
+func storeTokenFile(path, value string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(value+"\n"), 0600)
+}
+
+// storeEncryptedToken sets key in the YAML mapping of an encrypted file,
+// keeping the other tokens stored in it.
+func storeEncryptedToken(path, key, value string) error {
+	secret, err := config.OpenSecretFile(path)
+	if err != nil {
+		return err
+	}
+	tokens := map[string]string{}
+	if err := yaml.Unmarshal(secret.Plaintext, &tokens); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	tokens[key] = value
+
+	plaintext, err := yaml.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	sealed, err := secret.Seal(plaintext)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, sealed, 0600)
+}
+
+// elementSinks lists the sinks of the tokens and triggers of a project or
+// group.
+func elementSinks(e config.GitlabElement) []*config.TokenSink {
+	var sinks []*config.TokenSink
+	for _, tokens := range [][]config.Token{e.DeployTokens, e.AccessTokens} {
+		for _, t := range tokens {
+			sinks = append(sinks, t.Sink)
+		}
+	}
+	for _, t := range e.Triggers {
+		sinks = append(sinks, t.Sink)
+	}
+	return sinks
+}
+
+// isTokenSink reports whether a variable of target receives a token, so
+// clean_unmanaged_variables keeps it.
+func isTokenSink(target string, variable config.Variable) bool {
+	for _, elements := range [][]config.GitlabElement{groups, projects} {
+		for _, e := range elements {
+			for _, sink := range elementSinks(e) {
+				if sink == nil || sink.Variable == nil || sink.Variable.Target() != target {
+					continue
+				}
+				if config.VariableID(sinkVariable(*sink.Variable, "")) == config.VariableID(variable) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func logTokenStored(fields logger.Fields, name string, sink *config.TokenSink) {
+	entry := logger.WithFields(fields).WithField("Token", name)
+	switch {
+	case sink.Variable != nil:
+		entry = entry.WithFields(logger.Fields{"Target": sink.Variable.Target(), "Variable": sink.Variable.Key})
+	case sink.File != "":
+		entry = entry.WithField("File", sink.File)
+	default:
+		entry = entry.WithField("File", sink.EncryptedFile)
+	}
+	entry.Info("Token stored")
+}
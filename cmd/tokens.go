@@ -0,0 +1,517 @@
+package cmd
+
+import (
+	"sheeva/config"
+	"sort"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	deployTokenKind = "deploy_token"
+	accessTokenKind = "access_token"
+)
+
+// liveToken is an active deploy or access token, with sorted scopes and the
+// expiry date as in the YAML.
+type liveToken struct {
+	ID          int
+	Name        string
+	Username    string
+	Scopes      []string
+	AccessLevel gitlab.AccessLevelValue
+	ExpiresAt   string
+}
+
+func (t liveToken) toConfig(kind string) config.Token {
+	token := config.Token{Name: t.Name, Scopes: t.Scopes, ExpiresAt: t.ExpiresAt}
+	if kind == deployTokenKind {
+		token.Username = t.Username
+	} else {
+		token.AccessLevel = config.AccessLevelName(t.AccessLevel)
+	}
+	return token
+}
+
+func dateOf(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// tokenClient holds the token calls of one kind for a project or group.
+// create returns the ID and the value of the new token.
+type tokenClient struct {
+	kind   string
+	list   func() ([]liveToken, error)
+	create func(token config.Token, expiresAt string) (int, string, error)
+	revoke func(id int) error
+}
+
+// tokenChange is a planned change together with the desired token and the
+// live one it replaces.
+type tokenChange struct {
+	plannedChange
+	Token  config.Token
+	LiveID int
+}
+
+// tokenAttributeChanges lists what differs between a token and the live
+// one. Tokens cannot be edited, so any difference replaces the token.
+func tokenAttributeChanges(kind string, desired config.Token, live liveToken) []string {
+	var changes []string
+	if strings.Join(sortedNames(desired.Scopes), ",") != strings.Join(live.Scopes, ",") {
+		changes = append(changes, "scopes")
+	}
+	if kind == deployTokenKind && desired.Username != "" && desired.Username != live.Username {
+		changes = append(changes, "username")
+	}
+	if kind == accessTokenKind && desired.AccessLevel != "" {
+		if level, err := config.ParseAccessLevel(desired.AccessLevel); err == nil && level != live.AccessLevel {
+			changes = append(changes, "access_level")
+		}
+	}
+	if desired.ExpiresAt != "" && desired.ExpiresAt != live.ExpiresAt {
+		changes = append(changes, "expires_at")
+	}
+	return changes
+}
+
+// dueForRotation reports whether the token expires within rotate_before.
+func dueForRotation(desired config.Token, live liveToken, now time.Time) bool {
+	if desired.RotateBefore == "" || live.ExpiresAt == "" {
+		return false
+	}
+	before, err := config.ParseDuration(desired.RotateBefore)
+	if err != nil {
+		return false
+	}
+	expiresAt, err := config.ParseDate(live.ExpiresAt)
+	if err != nil {
+		return false
+	}
+	return !now.Add(before).Before(expiresAt)
+}
+
+func (c tokenClient) changes(target string, desired []config.Token, clean bool, now time.Time) ([]tokenChange, error) {
+	live, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	// Several tokens may share a name, the newest one is the managed one
+	sort.Slice(live, func(i, j int) bool { return live[i].ID > live[j].ID })
+	liveByName := make(map[string]liveToken, len(live))
+	for _, t := range live {
+		if _, ok := liveByName[t.Name]; !ok {
+			liveByName[t.Name] = t
+		}
+	}
+
+	var changes []tokenChange
+	desiredNames := make(map[string]bool, len(desired))
+	for _, t := range desired {
+		desiredNames[t.Name] = true
+		change := tokenChange{
+			plannedChange: plannedChange{Kind: c.kind, Target: target, Name: t.Name},
+			Token:         t,
+		}
+		current, ok := liveByName[t.Name]
+		switch {
+		case !ok:
+			change.Action = actionCreate
+		case len(tokenAttributeChanges(c.kind, t, current)) > 0:
+			change.Action, change.Changes, change.LiveID = actionReplace, tokenAttributeChanges(c.kind, t, current), current.ID
+		case dueForRotation(t, current, now):
+			change.Action, change.Changes, change.LiveID = actionRotate, []string{"expires_at"}, current.ID
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	if clean {
+		for _, t := range live {
+			if !desiredNames[t.Name] {
+				changes = append(changes, tokenChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: c.kind, Target: target, Name: t.Name},
+					LiveID:        t.ID,
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// apply creates tokens before revoking the ones they replace, and revokes
+// a replaced token only once the new value is stored, so the consumers of
+// a token are never left without a working one. A new token which cannot be
+// stored is revoked, so the next run creates it again. Tokens without a sink
+// are only created.
+func (c tokenClient) apply(fields logger.Fields, changes []tokenChange, client *gitlab.Client, now time.Time) {
+	for _, change := range changes {
+		entry := logger.WithFields(fields).WithFields(logger.Fields{
+			"Action": change.Action,
+			"Kind":   change.Kind,
+			"Token":  change.Name,
+		})
+		if change.Action == actionDelete {
+			if err := c.revoke(change.LiveID); err != nil {
+				entry.WithField("Error", err).Warning("Error ocured while revoking token")
+			}
+			continue
+		}
+
+		id, value, err := c.create(change.Token, change.Token.Expiry(now))
+		if err != nil {
+			entry.WithField("Error", err).Warning("Error ocured while creating token")
+			continue
+		}
+		if change.Token.Sink != nil {
+			if err := storeToken(change.Token.Name, change.Token.Sink, value, client); err != nil {
+				entry.WithField("Error", err).Error("Error ocured while storing token, revoking the new token")
+				if err := c.revoke(id); err != nil {
+					entry.WithField("Error", err).Error("Error ocured while revoking unstored token, revoke it manually")
+				}
+				continue
+			}
+			logTokenStored(fields, change.Token.Name, change.Token.Sink)
+		}
+		if change.LiveID != 0 {
+			if err := c.revoke(change.LiveID); err != nil {
+				entry.WithField("Error", err).Warning("Error ocured while revoking replaced token")
+			}
+		}
+	}
+}
+
+func isoTime(date string) *gitlab.ISOTime {
+	if date == "" {
+		return nil
+	}
+	t, err := config.ParseDate(date)
+	if err != nil {
+		return nil
+	}
+	iso := gitlab.ISOTime(t)
+	return &iso
+}
+
+func timeOf(date string) *time.Time {
+	if date == "" {
+		return nil
+	}
+	t, err := config.ParseDate(date)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func accessLevelOf(name string) *gitlab.AccessLevelValue {
+	if name == "" {
+		return nil
+	}
+	level, err := config.ParseAccessLevel(name)
+	if err != nil {
+		return nil
+	}
+	return gitlab.AccessLevel(level)
+}
+
+func liveDeployTokens(tokens []*gitlab.DeployToken) []liveToken {
+	var live []liveToken
+	for _, t := range tokens {
+		if t.Revoked || t.Expired {
+			continue
+		}
+		live = append(live, liveToken{ID: t.ID, Name: t.Name, Username: t.Username, Scopes: sortedNames(t.Scopes), ExpiresAt: dateOf(t.ExpiresAt)})
+	}
+	return live
+}
+
+func projectDeployTokenClient(projectId int, client *gitlab.Client) tokenClient {
+	return tokenClient{
+		kind: deployTokenKind,
+		list: func() ([]liveToken, error) {
+			var live []liveToken
+			opts := &gitlab.ListProjectDeployTokensOptions{PerPage: 100}
+			for {
+				tokens, resp, err := client.DeployTokens.ListProjectDeployTokens(projectId, opts)
+				if err != nil {
+					return nil, err
+				}
+				live = append(live, liveDeployTokens(tokens)...)
+				if resp.NextPage == 0 {
+					return live, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(t config.Token, expiresAt string) (int, string, error) {
+			opt := &gitlab.CreateProjectDeployTokenOptions{
+				Name:      gitlab.String(t.Name),
+				Scopes:    &t.Scopes,
+				ExpiresAt: timeOf(expiresAt),
+			}
+			if t.Username != "" {
+				opt.Username = gitlab.String(t.Username)
+			}
+			token, _, err := client.DeployTokens.CreateProjectDeployToken(projectId, opt)
+			if err != nil {
+				return 0, "", err
+			}
+			return token.ID, token.Token, nil
+		},
+		revoke: func(id int) error {
+			_, err := client.DeployTokens.DeleteProjectDeployToken(projectId, id)
+			return err
+		},
+	}
+}
+
+func groupDeployTokenClient(groupID int, client *gitlab.Client) tokenClient {
+	return tokenClient{
+		kind: deployTokenKind,
+		list: func() ([]liveToken, error) {
+			var live []liveToken
+			opts := &gitlab.ListGroupDeployTokensOptions{PerPage: 100}
+			for {
+				tokens, resp, err := client.DeployTokens.ListGroupDeployTokens(groupID, opts)
+				if err != nil {
+					return nil, err
+				}
+				live = append(live, liveDeployTokens(tokens)...)
+				if resp.NextPage == 0 {
+					return live, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(t config.Token, expiresAt string) (int, string, error) {
+			opt := &gitlab.CreateGroupDeployTokenOptions{
+				Name:      gitlab.String(t.Name),
+				Scopes:    &t.Scopes,
+				ExpiresAt: timeOf(expiresAt),
+			}
+			if t.Username != "" {
+				opt.Username = gitlab.String(t.Username)
+			}
+			token, _, err := client.DeployTokens.CreateGroupDeployToken(groupID, opt)
+			if err != nil {
+				return 0, "", err
+			}
+			return token.ID, token.Token, nil
+		},
+		revoke: func(id int) error {
+			_, err := client.DeployTokens.DeleteGroupDeployToken(groupID, id)
+			return err
+		},
+	}
+}
+
+func projectAccessTokenClient(projectId int, client *gitlab.Client) tokenClient {
+	return tokenClient{
+		kind: accessTokenKind,
+		list: func() ([]liveToken, error) {
+			var live []liveToken
+			opts := &gitlab.ListProjectAccessTokensOptions{PerPage: 100}
+			for {
+				tokens, resp, err := client.ProjectAccessTokens.ListProjectAccessTokens(projectId, opts)
+				if err != nil {
+					return nil, err
+				}
+				for _, t := range tokens {
+					if t.Active {
+						live = append(live, liveToken{ID: t.ID, Name: t.Name, Scopes: sortedNames(t.Scopes), AccessLevel: t.AccessLevel, ExpiresAt: isoDate(t.ExpiresAt)})
+					}
+				}
+				if resp.NextPage == 0 {
+					return live, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(t config.Token, expiresAt string) (int, string, error) {
+			token, _, err := client.ProjectAccessTokens.CreateProjectAccessToken(projectId, &gitlab.CreateProjectAccessTokenOptions{
+				Name:        gitlab.String(t.Name),
+				Scopes:      &t.Scopes,
+				AccessLevel: accessLevelOf(t.AccessLevel),
+				ExpiresAt:   isoTime(expiresAt),
+			})
+			if err != nil {
+				return 0, "", err
+			}
+			return token.ID, token.Token, nil
+		},
+		revoke: func(id int) error {
+			_, err := client.ProjectAccessTokens.RevokeProjectAccessToken(projectId, id)
+			return err
+		},
+	}
+}
+
+func groupAccessTokenClient(groupID int, client *gitlab.Client) tokenClient {
+	return tokenClient{
+		kind: accessTokenKind,
+		list: func() ([]liveToken, error) {
+			var live []liveToken
+			opts := &gitlab.ListGroupAccessTokensOptions{PerPage: 100}
+			for {
+				tokens, resp, err := client.GroupAccessTokens.ListGroupAccessTokens(groupID, opts)
+				if err != nil {
+					return nil, err
+				}
+				for _, t := range tokens {
+					if t.Active {
+						live = append(live, liveToken{ID: t.ID, Name: t.Name, Scopes: sortedNames(t.Scopes), AccessLevel: t.AccessLevel, ExpiresAt: isoDate(t.ExpiresAt)})
+					}
+				}
+				if resp.NextPage == 0 {
+					return live, nil
+				}
+				opts.Page = resp.NextPage
+			}
+		},
+		create: func(t config.Token, expiresAt string) (int, string, error) {
+			token, _, err := client.GroupAccessTokens.CreateGroupAccessToken(groupID, &gitlab.CreateGroupAccessTokenOptions{
+				Name:        gitlab.String(t.Name),
+				Scopes:      &t.Scopes,
+				AccessLevel: accessLevelOf(t.AccessLevel),
+				ExpiresAt:   isoTime(expiresAt),
+			})
+			if err != nil {
+				return 0, "", err
+			}
+			return token.ID, token.Token, nil
+		},
+		revoke: func(id int) error {
+			_, err := client.GroupAccessTokens.RevokeGroupAccessToken(groupID, id)
+			return err
+		},
+	}
+}
+
+// elementTokens pairs the token clients of a project or group with the
+// tokens it declares.
+type elementTokens struct {
+	client tokenClient
+	tokens []config.Token
+	clean  bool
+}
+
+func projectTokens(projectId int, project config.GitlabElement, client *gitlab.Client) []elementTokens {
+	return []elementTokens{
+		{projectDeployTokenClient(projectId, client), project.DeployTokens, project.CleanDeployTokens},
+		{projectAccessTokenClient(projectId, client), project.AccessTokens, project.CleanAccessTokens},
+	}
+}
+
+func groupTokens(groupID int, group config.GitlabElement, client *gitlab.Client) []elementTokens {
+	return []elementTokens{
+		{groupDeployTokenClient(groupID, client), group.DeployTokens, group.CleanDeployTokens},
+		{groupAccessTokenClient(groupID, client), group.AccessTokens, group.CleanAccessTokens},
+	}
+}
+
+func manageTokens(fields logger.Fields, element config.GitlabElement, all []elementTokens, client *gitlab.Client) error {
+	now := time.Now()
+	for _, e := range all {
+		if len(e.tokens) == 0 && !e.clean {
+			continue
+		}
+		changes, err := e.client.changes(elementPath(element), e.tokens, e.clean, now)
+		if err != nil {
+			return err
+		}
+		e.client.apply(fields, changes, client, now)
+	}
+	return nil
+}
+
+func planTokens(element config.GitlabElement, all []elementTokens) ([]plannedChange, error) {
+	var result []plannedChange
+	for _, e := range all {
+		if len(e.tokens) == 0 && !e.clean {
+			continue
+		}
+		changes, err := e.client.changes(elementPath(element), e.tokens, e.clean, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, planned(changes)...)
+	}
+	return result, nil
+}
+
+func ManageProjectTokens(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	return manageTokens(logger.Fields{"Project": elementPath(project)}, project, projectTokens(projectId, project, client), client)
+}
+
+func ManageGroupTokens(groupID int, group config.GitlabElement, client *gitlab.Client) error {
+	return manageTokens(logger.Fields{"Group": elementPath(group)}, group, groupTokens(groupID, group, client), client)
+}
+
+func planProjectTokens(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	return planTokens(project, projectTokens(projectId, project, gitlabClient))
+}
+
+func planGroupTokens(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	return planTokens(group, groupTokens(groupID, group, gitlabClient))
+}
+
+// tokenRules reports tokens which cannot be applied. Tokens without a sink
+// are allowed, but their value cannot be recovered.
+func tokenRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	check := func(field string, tokens []config.Token, deploy bool) {
+		seen := make(map[string]bool, len(tokens))
+		for _, t := range tokens {
+			name := field + "." + t.Name
+			if seen[t.Name] {
+				issues = append(issues, validationIssue{Target: target, Field: name, Message: "Duplicate token", Fatal: true})
+			}
+			seen[t.Name] = true
+			for _, problem := range config.CheckToken(t, deploy) {
+				issues = append(issues, validationIssue{Target: target, Field: name, Message: problem, Fatal: true})
+			}
+			if t.Sink == nil {
+				issues = append(issues, validationIssue{Target: target, Field: name, Message: "Token has no sink, the value of a new token will be lost"})
+			}
+		}
+	}
+	check("deploy_tokens", element.DeployTokens, true)
+	check("access_tokens", element.AccessTokens, false)
+	return issues
+}
+
+func importTokens(element *config.GitlabElement, all []elementTokens) error {
+	for _, e := range all {
+		live, err := e.client.list()
+		if err != nil {
+			return err
+		}
+		var tokens []config.Token
+		for _, t := range live {
+			tokens = append(tokens, t.toConfig(e.client.kind))
+		}
+		if e.client.kind == deployTokenKind {
+			element.DeployTokens, element.CleanDeployTokens = tokens, len(tokens) > 0
+		} else {
+			element.AccessTokens, element.CleanAccessTokens = tokens, len(tokens) > 0
+		}
+	}
+	return nil
+}
+
+func importProjectTokens(project *config.GitlabElement, projectId int) error {
+	return importTokens(project, projectTokens(projectId, *project, gitlabClient))
+}
+
+func importGroupTokens(group *config.GitlabElement, groupID int) error {
+	return importTokens(group, groupTokens(groupID, *group, gitlabClient))
+}
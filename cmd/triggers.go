@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const triggerKind = "trigger"
+
+func listTriggers(projectId int, client *gitlab.Client) ([]*gitlab.PipelineTrigger, error) {
+	var triggers []*gitlab.PipelineTrigger
+	opts := &gitlab.ListPipelineTriggersOptions{PerPage: 100}
+	for {
+		page, resp, err := client.PipelineTriggers.ListPipelineTriggers(projectId, opts)
+		if err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, page...)
+		if resp.NextPage == 0 {
+			return triggers, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// triggerChange is a planned change together with the desired trigger and
+// the ID of the live one.
+type triggerChange struct {
+	plannedChange
+	Trigger config.Trigger
+	LiveID  int
+}
+
+// triggerChanges compares the triggers of the project with the live ones by
+// description. A trigger has nothing else to update.
+func triggerChanges(projectId int, project config.GitlabElement, client *gitlab.Client) ([]triggerChange, error) {
+	target := elementPath(project)
+	live, err := listTriggers(projectId, client)
+	if err != nil {
+		return nil, err
+	}
+	liveDescriptions := make(map[string]bool, len(live))
+	for _, t := range live {
+		liveDescriptions[t.Description] = true
+	}
+
+	var changes []triggerChange
+	desired := make(map[string]bool, len(project.Triggers))
+	for _, t := range project.Triggers {
+		desired[t.Description] = true
+		if !liveDescriptions[t.Description] {
+			changes = append(changes, triggerChange{
+				plannedChange: plannedChange{Action: actionCreate, Kind: triggerKind, Target: target, Name: t.Description},
+				Trigger:       t,
+			})
+		}
+	}
+
+	if project.CleanUnmanagedTriggers {
+		for _, t := range live {
+			if !desired[t.Description] {
+				changes = append(changes, triggerChange{
+					plannedChange: plannedChange{Action: actionDelete, Kind: triggerKind, Target: target, Name: t.Description},
+					LiveID:        t.ID,
+				})
+			}
+		}
+	}
+	return changes, nil
+}
+
+func manageTriggers(project config.GitlabElement) bool {
+	return len(project.Triggers) > 0 || project.CleanUnmanagedTriggers
+}
+
+func ManageTriggers(projectId int, project config.GitlabElement, client *gitlab.Client) error {
+	if !manageTriggers(project) {
+		return nil
+	}
+	changes, err := triggerChanges(projectId, project, client)
+	if err != nil {
+		return err
+	}
+
+	fields := logger.Fields{"Project": elementPath(project)}
+	for _, change := range changes {
+		entry := logger.WithFields(fields).WithFields(logger.Fields{
+			"Action":  change.Action,
+			"Trigger": change.Name,
+		})
+		if change.Action == actionDelete {
+			if _, err := client.PipelineTriggers.DeletePipelineTrigger(projectId, change.LiveID); err != nil {
+				entry.WithField("Error", err).Warning("Error ocured while deleting trigger")
+			}
+			continue
+		}
+
+		trigger, _, err := client.PipelineTriggers.AddPipelineTrigger(projectId, &gitlab.AddPipelineTriggerOptions{
+			Description: gitlab.String(change.Trigger.Description),
+		})
+		if err != nil {
+			entry.WithField("Error", err).Warning("Error ocured while creating trigger")
+			continue
+		}
+		if change.Trigger.Sink == nil {
+			continue
+		}
+		// A trigger whose token is lost is deleted, so the next run creates it again
+		if err := storeToken(change.Trigger.Description, change.Trigger.Sink, trigger.Token, client); err != nil {
+			entry.WithField("Error", err).Error("Error ocured while storing trigger token, deleting the new trigger")
+			if _, err := client.PipelineTriggers.DeletePipelineTrigger(projectId, trigger.ID); err != nil {
+				entry.WithField("Error", err).Error("Error ocured while deleting unstored trigger, delete it manually")
+			}
+			continue
+		}
+		logTokenStored(fields, change.Trigger.Description, change.Trigger.Sink)
+	}
+	return nil
+}
+
+func planTriggers(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	if !manageTriggers(project) {
+		return nil, nil
+	}
+	changes, err := triggerChanges(projectId, project, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	return planned(changes), nil
+}
+
+func importTriggers(project *config.GitlabElement, projectId int) error {
+	triggers, err := listTriggers(projectId, gitlabClient)
+	if err != nil {
+		return err
+	}
+	for _, t := range triggers {
+		project.Triggers = append(project.Triggers, config.Trigger{Description: t.Description})
+	}
+	project.CleanUnmanagedTriggers = len(triggers) > 0
+	return nil
+}
+
+// triggerRules reports triggers which cannot be applied. Triggers without a
+// sink are allowed, but their token cannot be recovered.
+func triggerRules(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+	if kind != projectKind {
+		if len(element.Triggers) > 0 {
+			issues = append(issues, validationIssue{Target: target, Field: "triggers", Message: "Triggers are only supported on projects", Fatal: true})
+		}
+		return issues
+	}
+
+	seen := make(map[string]bool, len(element.Triggers))
+	for _, t := range element.Triggers {
+		field := "triggers." + t.Description
+		if seen[t.Description] {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Duplicate trigger", Fatal: true})
+		}
+		seen[t.Description] = true
+		for _, problem := range config.CheckTrigger(t) {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: problem, Fatal: true})
+		}
+		if t.Sink == nil {
+			issues = append(issues, validationIssue{Target: target, Field: field, Message: "Trigger has no sink, the token of a new trigger will be lost"})
+		}
+	}
+	return issues
+}
@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sheeva/config"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	groupKind    = "group"
+	projectKind  = "project"
+	instanceKind = "instance"
+)
+
+type validationIssue struct {
+	Target  string
+	Field   string
+	Message string
+	Fatal   bool
+}
+
+type validator func(kind string, element config.GitlabElement) []validationIssue
+
+func failOnSecrets() bool {
+	return os.Getenv("SHEEVA_FAIL_ON_SECRETS") == "1"
+}
+
+func elementPath(element config.GitlabElement) string {
+	if element.Name == element.Namespace {
+		return element.Name
+	}
+	return element.Namespace + "/" + element.Name
+}
+
+// Validate checks groups and projects without calling GitLab. Every issue is
+// logged; an error is returned when at least one of them is fatal.
+func Validate() error {
+	return validate(localGitlabVersion(), false)
+}
+
+// validate checks the configuration against the rules of the given GitLab
+// version. Values from value_from providers are only checked when resolve is
+// set, since fetching them needs access to the secret backends.
+func validate(version config.GitlabVersion, resolve bool) error {
+	allowlist, err := config.LoadSecretAllowlist(rootDir)
+	if err != nil {
+		return err
+	}
+	validators := []validator{
+		secretScanner{allowlist: allowlist, fatal: failOnSecrets()}.validate,
+		variableRules{version: version, resolve: resolve}.validate,
+		memberRules,
+		groupLinkRules,
+		deployKeyRules,
+		protectedBranchRules,
+		protectedTagRules,
+		approvalRules,
+		pushRuleRules,
+		tokenRules,
+		labelRules,
+		milestoneRules,
+		badgeRules,
+		environmentRules,
+		triggerRules,
+		jobTokenScopeRules,
+		mirrorRules,
+		registryRules,
+	}
+
+	var issues []validationIssue
+	if !instance.IsEmpty() {
+		for _, v := range validators {
+			issues = append(issues, v(instanceKind, instanceElement())...)
+		}
+	}
+	for _, g := range groups {
+		for _, v := range validators {
+			issues = append(issues, v(groupKind, g)...)
+		}
+	}
+	for _, p := range projects {
+		for _, v := range validators {
+			issues = append(issues, v(projectKind, p)...)
+		}
+	}
+
+	var fatal int
+	for _, issue := range issues {
+		entry := logger.WithFields(logger.Fields{
+			"Target": issue.Target,
+			"Field":  issue.Field,
+		})
+		if issue.Fatal {
+			fatal++
+			entry.Error(issue.Message)
+		} else {
+			entry.Warning(issue.Message)
+		}
+	}
+
+	logger.WithFields(logger.Fields{
+		"Groups":   len(groups),
+		"Projects": len(projects),
+		"Issues":   len(issues),
+		"Fatal":    fatal,
+	}).Info("Validation finished")
+	if fatal > 0 {
+		return fmt.Errorf("%d validation errors", fatal)
+	}
+	return nil
+}
+
+// secretScanner flags values which look like credentials but are stored in
+// plain text: inline variables, webhook tokens and mirror passwords, and
+// variables or webhooks files which are not encrypted with sops or age.
+type secretScanner struct {
+	allowlist config.SecretAllowlist
+	fatal     bool
+}
+
+func (s secretScanner) validate(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+
+	check := func(field, key, value string) {
+		reason := config.DetectSecret(value)
+		if reason == "" || s.allowlist.Allowed(target, key, value) {
+			return
+		}
+		issues = append(issues, validationIssue{
+			Target:  target,
+			Field:   field,
+			Message: fmt.Sprintf("Possible plaintext secret in %s: %s", kind, reason),
+			Fatal:   s.fatal,
+		})
+	}
+	checkVariables := func(prefix string, variables []config.Variable) {
+		for _, v := range variables {
+			if v.ValueFrom == nil {
+				check(prefix+v.Key, v.Key, v.Value)
+			}
+		}
+	}
+	checkHooks := func(prefix string, hooks []config.Hook) {
+		for _, h := range hooks {
+			check(prefix+h.URL+".token", "token", h.Token)
+		}
+	}
+
+	checkVariables("variables.", element.Variables)
+	for _, sched := range element.Sched {
+		checkVariables("sched."+sched.Description+".variables.", sched.Variables)
+	}
+	checkHooks("webhooks.", element.Hooks)
+	for _, m := range element.Mirrors {
+		check("mirrors."+config.StripCredentials(m.URL)+".password", "password", m.Password)
+	}
+	if m := element.PullMirror; m != nil {
+		check("pull_mirror.password", "password", m.Password)
+	}
+
+	if file := element.VariablesFile; file.Path != "" {
+		fileVariables, err := config.ParsePlainVariables(file)
+		if err != nil {
+			issues = append(issues, fileIssue(target, file.Path, err))
+		}
+		checkVariables(file.Path+":", fileVariables.Variables)
+	}
+	if file := element.HooksFile; file != "" && !s.encrypted(file, target, &issues) {
+		fileHooks, err := config.ParseHooksFile(file)
+		if err != nil {
+			issues = append(issues, fileIssue(target, file, err))
+		}
+		checkHooks(file+":", fileHooks.Hooks)
+	}
+
+	return issues
+}
+
+func (s secretScanner) encrypted(file, target string, issues *[]validationIssue) bool {
+	encrypted, err := config.IsEncryptedFile(file)
+	if err != nil {
+		*issues = append(*issues, fileIssue(target, file, err))
+		return true
+	}
+	return encrypted
+}
+
+func fileIssue(target, file string, err error) validationIssue {
+	return validationIssue{
+		Target:  target,
+		Field:   file,
+		Message: err.Error(),
+		Fatal:   true,
+	}
+}
+
+// variableRules reports variables GitLab would reject, e.g. masked values
+// which are too short or contain characters GitLab cannot mask, or several
+// variables with the same key and environment scope.
+type variableRules struct {
+	version config.GitlabVersion
+	resolve bool
+}
+
+func (r variableRules) validate(kind string, element config.GitlabElement) []validationIssue {
+	target := elementPath(element)
+	var issues []validationIssue
+
+	check := variableCheck(config.CheckVariable)
+	if kind == instanceKind {
+		check = config.CheckInstanceVariable
+	}
+
+	seen := make(map[string]string)
+	checkVariables := func(field string, variables []config.Variable) {
+		for _, v := range variables {
+			id := config.VariableID(v)
+			if first, ok := seen[id]; ok {
+				issues = append(issues, validationIssue{
+					Target:  target,
+					Field:   field + v.Key,
+					Message: fmt.Sprintf("Duplicate variable %s, already defined in %s", id, first),
+					Fatal:   true,
+				})
+			} else {
+				seen[id] = field + v.Key
+			}
+			if v.ValueFrom != nil {
+				if !r.resolve {
+					continue
+				}
+				value, err := config.ResolveValue(v)
+				if err != nil {
+					issues = append(issues, validationIssue{Target: target, Field: field + v.Key, Message: err.Error(), Fatal: true})
+					continue
+				}
+				v.Value = value
+			}
+			for _, problem := range check(v, r.version) {
+				issues = append(issues, validationIssue{Target: target, Field: field + v.Key, Message: problem, Fatal: true})
+			}
+		}
+	}
+
+	checkVariables("variables.", element.Variables)
+	if file := element.VariablesFile; file.Path != "" {
+		fileVariables, err := config.ParseVariableFile(file)
+		if err != nil {
+			issues = append(issues, fileIssue(target, file.Path, err))
+		}
+		checkVariables(file.Path+":", fileVariables.Variables)
+	}
+	return issues
+}
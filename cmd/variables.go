@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sheeva/config"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+const (
+	defaultEnvironmentScope = config.DefaultEnvironmentScope
+	defaultVariableType     = "env_var"
+)
+
+// desiredVariables returns the variables to apply to element and whether
+// unmanaged variables may be cleaned. A variable which failed to load or
+// validate is missing from the list, so cleaning would delete it: it is only
+// allowed when every declared variable made it.
+func desiredVariables(fields logger.Fields, element config.GitlabElement, check variableCheck) ([]config.Variable, bool) {
+	loaded, complete := loadVariables(fields, element)
+	variables, valid := compliantVariables(fields, loaded, check)
+
+	clean := element.CleanUnmanagedVars && complete && valid
+	if element.CleanUnmanagedVars && !clean {
+		logger.WithFields(fields).Warning("Unmanaged variables are not cleaned because some variables were not loaded")
+	}
+	return variables, clean
+}
+
+// loadVariables merges inline variables with the variables_file and resolves
+// value_from. Variables which cannot be loaded are logged and left out, the
+// result is then reported as incomplete.
+func loadVariables(fields logger.Fields, element config.GitlabElement) ([]config.Variable, bool) {
+	complete := true
+	variables := element.Variables
+	if element.VariablesFile.Path != "" {
+		fileVariables, err := config.ParseVariableFile(element.VariablesFile)
+		if err != nil {
+			complete = false
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error": err,
+			}).Error("Error ocured while parsing variable file")
+		}
+		variables = append(variables, fileVariables.Variables...)
+	}
+
+	resolved, errs := config.ResolveVariables(variables)
+	for id, err := range errs {
+		complete = false
+		logger.WithFields(fields).WithFields(logger.Fields{
+			"Error":    err,
+			"Variable": id,
+		}).Error("Error ocured while resolving variable value")
+	}
+	return resolved, complete
+}
+
+// variableCheck returns the reasons GitLab would reject a variable.
+type variableCheck func(config.Variable, config.GitlabVersion) []string
+
+// compliantVariables leaves out variables GitLab would reject, so they are
+// reported up front instead of failing halfway through the API calls. Of
+// several variables with the same key and environment scope only the first
+// one is kept. The result is false when a variable was rejected.
+func compliantVariables(fields logger.Fields, variables []config.Variable, check variableCheck) ([]config.Variable, bool) {
+	version := gitlabVersion()
+
+	valid := true
+	var compliant []config.Variable
+	seen := make(map[string]bool, len(variables))
+	for _, variable := range variables {
+		id := config.VariableID(variable)
+		if seen[id] {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Variable": id,
+			}).Error("Duplicate variable rejected by local validation")
+			continue
+		}
+		seen[id] = true
+		if problems := check(variable, version); len(problems) > 0 {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Variable": variable.Key,
+				"Problems": strings.Join(problems, "; "),
+				"Version":  version.String(),
+			}).Error("Variable rejected by local validation")
+			valid = false
+			continue
+		}
+		compliant = append(compliant, variable)
+	}
+	return compliant, valid
+}
+
+func normalizeVariable(v config.Variable) config.Variable {
+	if v.Environment == "" {
+		v.Environment = defaultEnvironmentScope
+	}
+	if v.VariableType == "" {
+		v.VariableType = defaultVariableType
+	}
+	v.State = ""
+	v.ValueFrom = nil
+	return v
+}
+
+// apiVariable is a project or group variable as returned by the API,
+// including attributes added to GitLab after the go-gitlab release this
+// module uses. Hidden variables are returned without a value.
+type apiVariable struct {
+	Key              string `json:"key"`
+	Value            string `json:"value"`
+	VariableType     string `json:"variable_type"`
+	Protected        bool   `json:"protected"`
+	Masked           bool   `json:"masked"`
+	Hidden           bool   `json:"hidden"`
+	Raw              bool   `json:"raw"`
+	EnvironmentScope string `json:"environment_scope"`
+	Description      string `json:"description"`
+}
+
+func (v apiVariable) toConfig() config.Variable {
+	return config.Variable{
+		Key:          v.Key,
+		VariableType: v.VariableType,
+		Protected:    v.Protected,
+		Masked:       v.Masked,
+		Hidden:       v.Hidden,
+		Raw:          v.Raw,
+		Environment:  v.EnvironmentScope,
+		Description:  v.Description,
+		Value:        v.Value,
+	}
+}
+
+// variableAttributes extends the go-gitlab variable options with attributes
+// it does not know yet. The options are sent as a JSON body, so the fields
+// of both structs end up side by side.
+type variableAttributes struct {
+	Description     *string `url:"description,omitempty" json:"description,omitempty"`
+	MaskedAndHidden *bool   `url:"masked_and_hidden,omitempty" json:"masked_and_hidden,omitempty"`
+}
+
+func newVariableAttributes(variable config.Variable, create bool) variableAttributes {
+	var attributes variableAttributes
+	if gitlabVersion().AtLeast(16, 2) {
+		attributes.Description = gitlab.String(variable.Description)
+	}
+	// Hiding is only possible when the variable is created
+	if create && variable.Hidden {
+		attributes.MaskedAndHidden = gitlab.Bool(true)
+	}
+	return attributes
+}
+
+func listVariables(client *gitlab.Client, path string) ([]config.Variable, error) {
+	var variables []config.Variable
+	opts := &gitlab.ListOptions{PerPage: 100}
+	for {
+		req, err := client.NewRequest(http.MethodGet, path, opts, nil)
+		if err != nil {
+			return nil, err
+		}
+		var vars []apiVariable
+		resp, err := client.Do(req, &vars)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vars {
+			variables = append(variables, v.toConfig())
+		}
+		if resp.NextPage == 0 {
+			return variables, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func listProjectVariables(projectId int, client *gitlab.Client) ([]config.Variable, error) {
+	return listVariables(client, fmt.Sprintf("projects/%d/variables", projectId))
+}
+
+func listGroupVariables(groupID int, client *gitlab.Client) ([]config.Variable, error) {
+	return listVariables(client, fmt.Sprintf("groups/%d/variables", groupID))
+}
+
+// variableChanges lists the attributes which differ between two variables.
+// Values are never part of the result, so it is safe to log.
+func variableChanges(desired, live config.Variable) []string {
+	desired, live = normalizeVariable(desired), normalizeVariable(live)
+
+	var changes []string
+	// The value of a hidden variable cannot be read back, so it is not compared
+	if desired.Value != live.Value && !live.Hidden {
+		changes = append(changes, "value")
+	}
+	if desired.VariableType != live.VariableType {
+		changes = append(changes, "variable_type")
+	}
+	if desired.Protected != live.Protected {
+		changes = append(changes, "protected")
+	}
+	if desired.Masked != live.Masked {
+		changes = append(changes, "masked")
+	}
+	if desired.Hidden != live.Hidden {
+		changes = append(changes, "hidden")
+	}
+	if desired.Raw != live.Raw {
+		changes = append(changes, "raw")
+	}
+	if desired.Description != live.Description {
+		changes = append(changes, "description")
+	}
+	return changes
+}
+
+// variableChange is a planned change together with the variable it applies
+// to: the desired variable for creates, updates and replaces, the live one
+// for deletes.
+type variableChange struct {
+	plannedChange
+	Variable config.Variable
+}
+
+// diffVariables compares desired variables with the live ones. Live variables
+// missing from the desired list are deleted only when clean is set.
+func diffVariables(target string, desired, live []config.Variable, clean bool) []variableChange {
+	liveByID := make(map[string]config.Variable, len(live))
+	for _, v := range live {
+		liveByID[config.VariableID(v)] = v
+	}
+
+	var changes []variableChange
+	add := func(action string, v config.Variable, attributes []string) {
+		changes = append(changes, variableChange{
+			plannedChange: plannedChange{Action: action, Kind: "variable", Target: target, Name: config.VariableID(v), Changes: attributes},
+			Variable:      normalizeVariable(v),
+		})
+	}
+
+	desiredIDs := make(map[string]bool, len(desired))
+	for _, v := range desired {
+		id := config.VariableID(v)
+		desiredIDs[id] = true
+
+		current, ok := liveByID[id]
+		switch {
+		case !ok:
+			add(actionCreate, v, nil)
+		case v.Hidden != current.Hidden:
+			// GitLab only hides variables when they are created
+			add(actionReplace, v, variableChanges(v, current))
+		case len(variableChanges(v, current)) > 0:
+			add(actionUpdate, v, variableChanges(v, current))
+		}
+	}
+
+	if clean {
+		for _, v := range live {
+			if !desiredIDs[config.VariableID(v)] && !isTokenSink(target, v) {
+				add(actionDelete, v, nil)
+			}
+		}
+	}
+	return changes
+}
+
+// variableClient performs variable changes on one project or group. Every
+// call addresses a single (key, environment scope) pair.
+type variableClient struct {
+	create func(config.Variable) error
+	update func(config.Variable) error
+	remove func(config.Variable) error
+}
+
+func (c variableClient) apply(fields logger.Fields, changes []variableChange) {
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case actionCreate:
+			err = c.create(change.Variable)
+		case actionUpdate:
+			err = c.update(change.Variable)
+		case actionReplace:
+			if err = c.remove(change.Variable); err == nil {
+				err = c.create(change.Variable)
+			}
+		case actionDelete:
+			err = c.remove(change.Variable)
+		}
+		if err != nil {
+			logger.WithFields(fields).WithFields(logger.Fields{
+				"Error":    err,
+				"Action":   change.Action,
+				"Variable": change.Name,
+			}).Warning("Error ocured while changing variable")
+		}
+	}
+}
+
+// variableFilter selects a single variable when several share the key.
+func variableFilter(variable config.Variable) *gitlab.VariableFilter {
+	return &gitlab.VariableFilter{EnvironmentScope: normalizeVariable(variable).Environment}
+}
+
+func planProjectVariables(project config.GitlabElement, projectId int) ([]plannedChange, error) {
+	fields := logger.Fields{"Project": elementPath(project)}
+	live, err := listProjectVariables(projectId, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	desired, clean := desiredVariables(fields, project, config.CheckVariable)
+	return planned(diffVariables(elementPath(project), desired, live, clean)), nil
+}
+
+func planGroupVariables(group config.GitlabElement, groupID int) ([]plannedChange, error) {
+	fields := logger.Fields{"Group": elementPath(group)}
+	live, err := listGroupVariables(groupID, gitlabClient)
+	if err != nil {
+		return nil, err
+	}
+	desired, clean := desiredVariables(fields, group, config.CheckVariable)
+	return planned(diffVariables(elementPath(group), desired, live, clean)), nil
+}
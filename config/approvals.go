@@ -0,0 +1,47 @@
+package config
+
+// Approvals configures merge request approvals. Settings left out are not
+// managed. On groups they are the defaults GitLab applies to the projects of
+// the group, rules and approvals_before_merge exist on projects only.
+type Approvals struct {
+	ApprovalsBeforeMerge     *int           `yaml:"approvals_before_merge,omitempty"`
+	ResetApprovalsOnPush     *bool          `yaml:"reset_approvals_on_push,omitempty"`
+	PreventAuthorApproval    *bool          `yaml:"prevent_author_approval,omitempty"`
+	PreventCommitterApproval *bool          `yaml:"prevent_committer_approval,omitempty"`
+	RequirePassword          *bool          `yaml:"require_password,omitempty"`
+	Rules                    []ApprovalRule `yaml:"rules,omitempty"`
+	CleanUnmanagedRules      bool           `yaml:"clean_unmanaged_rules,omitempty"`
+}
+
+// ApprovalRule requires approvals from the eligible users and groups. Without
+// protected branches the rule applies to every branch.
+type ApprovalRule struct {
+	Name              string   `yaml:"name"`
+	ApprovalsRequired int      `yaml:"approvals_required"`
+	Users             []string `yaml:"users,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+	ProtectedBranches []string `yaml:"protected_branches,omitempty"`
+}
+
+// CheckApprovals returns the reasons the approval settings cannot be applied.
+func CheckApprovals(approvals Approvals) []string {
+	var problems []string
+	if approvals.ApprovalsBeforeMerge != nil && *approvals.ApprovalsBeforeMerge < 0 {
+		problems = append(problems, "approvals_before_merge must not be negative")
+	}
+	seen := make(map[string]bool, len(approvals.Rules))
+	for _, r := range approvals.Rules {
+		if r.Name == "" {
+			problems = append(problems, "approval rule name is required")
+			continue
+		}
+		if seen[r.Name] {
+			problems = append(problems, "duplicate approval rule "+r.Name)
+		}
+		seen[r.Name] = true
+		if r.ApprovalsRequired < 0 {
+			problems = append(problems, "approvals_required of rule "+r.Name+" must not be negative")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Badge is a badge of a project or group. The URLs may contain GitLab
+// placeholders like %{project_path}, which GitLab fills in per project.
+type Badge struct {
+	Name     string `yaml:"name"`
+	LinkURL  string `yaml:"link_url"`
+	ImageURL string `yaml:"image_url"`
+}
+
+var (
+	badgePlaceholder  = regexp.MustCompile(`%{([^}]*)}`)
+	badgePlaceholders = map[string]bool{
+		"project_path":        true,
+		"project_title":       true,
+		"project_name":        true,
+		"project_id":          true,
+		"project_namespace":   true,
+		"group_name":          true,
+		"gitlab_server":       true,
+		"gitlab_pages_domain": true,
+		"default_branch":      true,
+		"commit_sha":          true,
+		"latest_tag":          true,
+	}
+)
+
+// CheckBadge returns the reasons the badge cannot be applied.
+func CheckBadge(badge Badge) []string {
+	var problems []string
+	if badge.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	urls := map[string]string{"link_url": badge.LinkURL, "image_url": badge.ImageURL}
+	for _, field := range []string{"link_url", "image_url"} {
+		if urls[field] == "" {
+			problems = append(problems, field+" is required")
+		}
+		for _, m := range badgePlaceholder.FindAllStringSubmatch(urls[field], -1) {
+			if !badgePlaceholders[m[1]] {
+				problems = append(problems, fmt.Sprintf("%s has unknown placeholder %s", field, m[0]))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Values GitLab accepts for the container expiration policy.
+var (
+	ContainerCadences  = []string{"1d", "7d", "14d", "1month", "3month"}
+	ContainerOlderThan = []string{"7d", "14d", "30d", "90d"}
+	ContainerKeepN     = []int{1, 5, 10, 25, 50, 100}
+)
+
+// RegistryAccessLevels are the access levels of the container registry.
+var RegistryAccessLevels = []string{"disabled", "private", "enabled"}
+
+// ContainerPolicy is the cleanup policy of the container registry of a
+// project. Fields left out are not managed, or taken from a group.
+type ContainerPolicy struct {
+	Enabled         *bool  `yaml:"enabled,omitempty"`
+	Cadence         string `yaml:"cadence,omitempty"`
+	KeepN           *int   `yaml:"keep_n,omitempty"`
+	OlderThan       string `yaml:"older_than,omitempty"`
+	NameRegexDelete string `yaml:"name_regex_delete,omitempty"`
+	NameRegexKeep   string `yaml:"name_regex_keep,omitempty"`
+}
+
+// RegistrySettings are the package and container registry settings of a
+// project. Fields left out are not managed, or taken from a group.
+type RegistrySettings struct {
+	PackagesEnabled              *bool  `yaml:"packages_enabled,omitempty"`
+	ContainerRegistryAccessLevel string `yaml:"container_registry_access_level,omitempty"`
+}
+
+// Inherit returns the policy with the fields it leaves out taken from
+// defaults. Either may be nil.
+func (p *ContainerPolicy) Inherit(defaults *ContainerPolicy) *ContainerPolicy {
+	if p == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return p
+	}
+	merged := *p
+	if merged.Enabled == nil {
+		merged.Enabled = defaults.Enabled
+	}
+	if merged.Cadence == "" {
+		merged.Cadence = defaults.Cadence
+	}
+	if merged.KeepN == nil {
+		merged.KeepN = defaults.KeepN
+	}
+	if merged.OlderThan == "" {
+		merged.OlderThan = defaults.OlderThan
+	}
+	if merged.NameRegexDelete == "" {
+		merged.NameRegexDelete = defaults.NameRegexDelete
+	}
+	if merged.NameRegexKeep == "" {
+		merged.NameRegexKeep = defaults.NameRegexKeep
+	}
+	return &merged
+}
+
+// Inherit returns the settings with the fields they leave out taken from
+// defaults. Either may be nil.
+func (s *RegistrySettings) Inherit(defaults *RegistrySettings) *RegistrySettings {
+	if s == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return s
+	}
+	merged := *s
+	if merged.PackagesEnabled == nil {
+		merged.PackagesEnabled = defaults.PackagesEnabled
+	}
+	if merged.ContainerRegistryAccessLevel == "" {
+		merged.ContainerRegistryAccessLevel = defaults.ContainerRegistryAccessLevel
+	}
+	return &merged
+}
+
+func oneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckContainerPolicy returns the reasons the policy cannot be applied.
+func CheckContainerPolicy(p ContainerPolicy) []string {
+	var problems []string
+	if p.Cadence != "" && !oneOf(p.Cadence, ContainerCadences) {
+		problems = append(problems, fmt.Sprintf("cadence must be one of %s", strings.Join(ContainerCadences, ", ")))
+	}
+	if p.OlderThan != "" && !oneOf(p.OlderThan, ContainerOlderThan) {
+		problems = append(problems, fmt.Sprintf("older_than must be one of %s", strings.Join(ContainerOlderThan, ", ")))
+	}
+	if p.KeepN != nil {
+		valid := false
+		keepN := make([]string, 0, len(ContainerKeepN))
+		for _, n := range ContainerKeepN {
+			valid = valid || n == *p.KeepN
+			keepN = append(keepN, strconv.Itoa(n))
+		}
+		if !valid {
+			problems = append(problems, fmt.Sprintf("keep_n must be one of %s", strings.Join(keepN, ", ")))
+		}
+	}
+	// GitLab evaluates the patterns with RE2, as Go does
+	for _, r := range []struct{ field, pattern string }{
+		{"name_regex_delete", p.NameRegexDelete},
+		{"name_regex_keep", p.NameRegexKeep},
+	} {
+		if _, err := regexp.Compile(r.pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is invalid: %v", r.field, err))
+		}
+	}
+	return problems
+}
+
+// CheckRegistrySettings returns the reasons the settings cannot be applied.
+func CheckRegistrySettings(s RegistrySettings) []string {
+	var problems []string
+	if s.ContainerRegistryAccessLevel != "" && !oneOf(s.ContainerRegistryAccessLevel, RegistryAccessLevels) {
+		problems = append(problems, fmt.Sprintf("container_registry_access_level must be one of %s", strings.Join(RegistryAccessLevels, ", ")))
+	}
+	return problems
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeployKey is a deploy key of a project. Keys declared on a group are not
+// applied to the group, they are shared with the projects below it, which
+// reference them by title.
+type DeployKey struct {
+	Title   string `yaml:"title"`
+	Key     string `yaml:"key,omitempty"`
+	KeyFile string `yaml:"key_file,omitempty"`
+	CanPush bool   `yaml:"can_push,omitempty"`
+}
+
+// HasKey reports whether the public key is declared, inline or in a file.
+func (k DeployKey) HasKey() bool {
+	return k.Key != "" || k.KeyFile != ""
+}
+
+// PublicKey returns the public key, reading it from KeyFile when it is not
+// inline.
+func (k DeployKey) PublicKey() (string, error) {
+	if k.Key != "" {
+		return strings.TrimSpace(k.Key), nil
+	}
+	data, err := ReadSecretFile(k.KeyFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// NormalizeKey drops the comment of a public key, which GitLab does not
+// keep reliably, so keys can be compared.
+func NormalizeKey(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) > 2 {
+		fields = fields[:2]
+	}
+	return strings.Join(fields, " ")
+}
+
+// CheckDeployKey returns the reasons the deploy key cannot be applied.
+func CheckDeployKey(key DeployKey) []string {
+	var problems []string
+	if key.Title == "" {
+		problems = append(problems, "title is required")
+	}
+	if key.Key != "" && key.KeyFile != "" {
+		problems = append(problems, "key and key_file are mutually exclusive")
+	}
+	if key.Key != "" && len(strings.Fields(key.Key)) < 2 {
+		problems = append(problems, fmt.Sprintf("key of %s is not an OpenSSH public key", key.Title))
+	}
+	return problems
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EnvironmentTiers are the deployment tiers of GitLab. Protected
+// environments of groups are named by tier.
+var EnvironmentTiers = []string{"production", "staging", "testing", "development", "other"}
+
+// Environment is an environment of a project.
+type Environment struct {
+	Name        string `yaml:"name"`
+	ExternalURL string `yaml:"external_url,omitempty"`
+	Tier        string `yaml:"tier,omitempty"`
+}
+
+// ProtectedEnv restricts who may deploy to an environment and who
+// has to approve deployments. On groups Name is a deployment tier.
+type ProtectedEnv struct {
+	Name                  string                    `yaml:"name"`
+	DeployAccessLevel     string                    `yaml:"deploy_access_level,omitempty"`
+	AllowedToDeploy       []AllowedAccess           `yaml:"allowed_to_deploy,omitempty"`
+	RequiredApprovalCount int                       `yaml:"required_approval_count,omitempty"`
+	ApprovalRules         []EnvironmentApprovalRule `yaml:"approval_rules,omitempty"`
+}
+
+// EnvironmentApprovalRule requires approvals of a role, a user or a group
+// before a deployment.
+type EnvironmentApprovalRule struct {
+	AccessLevel       string `yaml:"access_level,omitempty"`
+	User              string `yaml:"user,omitempty"`
+	Group             string `yaml:"group,omitempty"`
+	RequiredApprovals int    `yaml:"required_approvals,omitempty"`
+}
+
+func isTier(name string) bool {
+	for _, t := range EnvironmentTiers {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckEnvironment returns the reasons the environment cannot be applied.
+func CheckEnvironment(env Environment) []string {
+	var problems []string
+	if env.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if env.Tier != "" && !isTier(env.Tier) {
+		problems = append(problems, fmt.Sprintf("tier must be one of %s", strings.Join(EnvironmentTiers, ", ")))
+	}
+	return problems
+}
+
+// CheckProtectedEnv returns the reasons the protection cannot be
+// applied. group tells a protection of a group, named by tier.
+func CheckProtectedEnv(env ProtectedEnv, group bool) []string {
+	var problems []string
+	if env.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if group && env.Name != "" && !isTier(env.Name) {
+		problems = append(problems, fmt.Sprintf("protected environments of groups are named by tier, one of %s", strings.Join(EnvironmentTiers, ", ")))
+	}
+	problems = append(problems, CheckAllowedAccess(env.DeployAccessLevel, env.AllowedToDeploy)...)
+	for _, a := range env.AllowedToDeploy {
+		if a.DeployKey != "" {
+			problems = append(problems, "deploy keys cannot be allowed to deploy")
+		}
+	}
+	if env.RequiredApprovalCount < 0 {
+		problems = append(problems, "required_approval_count cannot be negative")
+	}
+	if env.RequiredApprovalCount > 0 && len(env.ApprovalRules) > 0 {
+		problems = append(problems, "required_approval_count and approval_rules are mutually exclusive")
+	}
+
+	for _, r := range env.ApprovalRules {
+		set := 0
+		for _, v := range []string{r.AccessLevel, r.User, r.Group} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			problems = append(problems, "approval rules need exactly one of access_level, user and group")
+		}
+		if r.AccessLevel != "" {
+			if _, err := ParseProtectionLevel(r.AccessLevel); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if r.RequiredApprovals < 0 {
+			problems = append(problems, "required_approvals cannot be negative")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GitlabVersion is the major and minor version of the GitLab instance. The
+// zero value means the version is unknown and the newest rules apply.
+type GitlabVersion struct {
+	Major int
+	Minor int
+}
+
+// ParseGitlabVersion parses versions as returned by /api/v4/version, e.g.
+// "16.4.1-ee".
+func ParseGitlabVersion(s string) (GitlabVersion, error) {
+	var v GitlabVersion
+	parts := strings.SplitN(strings.TrimPrefix(s, "v"), ".", 3)
+	if len(parts) < 2 {
+		return v, fmt.Errorf("invalid GitLab version %q", s)
+	}
+
+	var err error
+	if v.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return v, fmt.Errorf("invalid GitLab version %q", s)
+	}
+	minor := strings.FieldsFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if len(minor) == 0 {
+		return v, fmt.Errorf("invalid GitLab version %q", s)
+	}
+	if v.Minor, err = strconv.Atoi(minor[0]); err != nil {
+		return v, fmt.Errorf("invalid GitLab version %q", s)
+	}
+	return v, nil
+}
+
+// AtLeast reports whether the version is major.minor or newer.
+func (v GitlabVersion) AtLeast(major, minor int) bool {
+	if v == (GitlabVersion{}) {
+		return true
+	}
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
+
+func (v GitlabVersion) String() string {
+	if v == (GitlabVersion{}) {
+		return "latest"
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
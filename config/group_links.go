@@ -0,0 +1,43 @@
+package config
+
+// LDAPLink grants group access to the members of an LDAP group, selected by
+// its cn, or to the users matching an LDAP filter.
+type LDAPLink struct {
+	Provider    string `yaml:"provider"`
+	CN          string `yaml:"cn,omitempty"`
+	Filter      string `yaml:"filter,omitempty"`
+	AccessLevel string `yaml:"access_level"`
+}
+
+// SAMLLink grants group access to the members of a SAML group.
+type SAMLLink struct {
+	Name        string `yaml:"saml_group_name"`
+	AccessLevel string `yaml:"access_level"`
+}
+
+// CheckLDAPLink returns the reasons the link cannot be applied.
+func CheckLDAPLink(link LDAPLink) []string {
+	var problems []string
+	if link.Provider == "" {
+		problems = append(problems, "provider is required")
+	}
+	if (link.CN == "") == (link.Filter == "") {
+		problems = append(problems, "exactly one of cn and filter is required")
+	}
+	if _, err := ParseAccessLevel(link.AccessLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// CheckSAMLLink returns the reasons the link cannot be applied.
+func CheckSAMLLink(link SAMLLink) []string {
+	var problems []string
+	if link.Name == "" {
+		problems = append(problems, "saml_group_name is required")
+	}
+	if _, err := ParseAccessLevel(link.AccessLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
@@ -0,0 +1,38 @@
+package config
+
+import "strings"
+
+// JobTokenScope limits which projects may access a project with their
+// CI_JOB_TOKEN. The allowlist is managed as a whole, entries left out are
+// removed. Enabled left out keeps the current setting.
+type JobTokenScope struct {
+	Enabled  *bool    `yaml:"enabled,omitempty"`
+	Projects []string `yaml:"projects,omitempty"`
+	Groups   []string `yaml:"groups,omitempty"`
+}
+
+// CheckJobTokenScope returns the reasons the job token scope cannot be
+// applied.
+func CheckJobTokenScope(scope JobTokenScope) []string {
+	var problems []string
+	lists := []struct {
+		field string
+		paths []string
+	}{{"projects", scope.Projects}, {"groups", scope.Groups}}
+	for _, l := range lists {
+		field, paths := l.field, l.paths
+		seen := make(map[string]bool, len(paths))
+		for _, p := range paths {
+			if p == "" {
+				problems = append(problems, field+" cannot contain empty paths")
+			}
+			// GitLab paths are case-insensitive
+			key := strings.ToLower(p)
+			if seen[key] {
+				problems = append(problems, field+" lists "+p+" twice")
+			}
+			seen[key] = true
+		}
+	}
+	return problems
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Label is a label of a project or group. OldName renames an existing
+// label, like name_old does for projects, so issues keep their label.
+type Label struct {
+	Name        string `yaml:"name"`
+	OldName     string `yaml:"old_name,omitempty"`
+	Color       string `yaml:"color"`
+	Description string `yaml:"description,omitempty"`
+	Priority    *int   `yaml:"priority,omitempty"`
+}
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// CheckLabel returns the reasons the label cannot be applied. group tells
+// a group label, which has no priority, from a project label.
+func CheckLabel(label Label, group bool) []string {
+	var problems []string
+	if label.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if label.OldName != "" && label.OldName == label.Name {
+		problems = append(problems, "old_name is the same as name")
+	}
+	if !hexColor.MatchString(label.Color) {
+		problems = append(problems, fmt.Sprintf("color %q is not a hex color like #428BCA", label.Color))
+	}
+	if label.Priority != nil {
+		if group {
+			problems = append(problems, "priority is only supported on project labels")
+		} else if *label.Priority < 0 {
+			problems = append(problems, "priority cannot be negative")
+		}
+	}
+	return problems
+}
+
+// NormalizeColor expands a short hex color and upper-cases it, so colors
+// can be compared with the ones GitLab returns.
+func NormalizeColor(color string) string {
+	color = strings.ToUpper(color)
+	if len(color) == 4 && strings.HasPrefix(color, "#") {
+		return "#" + strings.Repeat(color[1:2], 2) + strings.Repeat(color[2:3], 2) + strings.Repeat(color[3:4], 2)
+	}
+	return color
+}
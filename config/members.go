@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// Member is a user with direct access to a project or group.
+type Member struct {
+	Username    string `yaml:"username"`
+	AccessLevel string `yaml:"access_level"`
+	ExpiresAt   string `yaml:"expires_at,omitempty"`
+}
+
+// SharedGroup grants the members of another group access to a project or
+// group.
+type SharedGroup struct {
+	Group       string `yaml:"group"`
+	AccessLevel string `yaml:"access_level"`
+	ExpiresAt   string `yaml:"expires_at,omitempty"`
+}
+
+const dateLayout = "2006-01-02"
+
+var accessLevels = map[string]gitlab.AccessLevelValue{
+	"minimal_access": gitlab.MinimalAccessPermissions,
+	"guest":          gitlab.GuestPermissions,
+	"reporter":       gitlab.ReporterPermissions,
+	"developer":      gitlab.DeveloperPermissions,
+	"maintainer":     gitlab.MaintainerPermissions,
+	"owner":          gitlab.OwnerPermissions,
+}
+
+// ParseAccessLevel converts an access level name like "developer" to the
+// value used by the API.
+func ParseAccessLevel(name string) (gitlab.AccessLevelValue, error) {
+	level, ok := accessLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown access level %q, expected one of %s", name, strings.Join(accessLevelNames(), ", "))
+	}
+	return level, nil
+}
+
+// AccessLevelName is the reverse of ParseAccessLevel.
+func AccessLevelName(level gitlab.AccessLevelValue) string {
+	for name, l := range accessLevels {
+		if l == level {
+			return name
+		}
+	}
+	return fmt.Sprint(int(level))
+}
+
+func accessLevelNames() []string {
+	names := make([]string, 0, len(accessLevels))
+	for name := range accessLevels {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return accessLevels[names[i]] < accessLevels[names[j]] })
+	return names
+}
+
+// ParseDate parses an expiry date like 2024-12-31.
+func ParseDate(date string) (time.Time, error) {
+	t, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return t, fmt.Errorf("expires_at must be a date like %s", dateLayout)
+	}
+	return t, nil
+}
+
+// CheckMember returns the reasons the member cannot be applied. group tells a
+// group member, only groups grant minimal access.
+func CheckMember(member Member, group bool) []string {
+	var problems []string
+	if member.Username == "" {
+		problems = append(problems, "username is required")
+	}
+	if level, err := ParseAccessLevel(member.AccessLevel); err == nil && level == gitlab.MinimalAccessPermissions && !group {
+		problems = append(problems, "minimal_access is only available for group members")
+	}
+	return append(problems, checkAccess(member.AccessLevel, member.ExpiresAt)...)
+}
+
+// CheckSharedGroup returns the reasons the share cannot be applied.
+func CheckSharedGroup(share SharedGroup) []string {
+	var problems []string
+	if share.Group == "" {
+		problems = append(problems, "group is required")
+	}
+	return append(problems, checkAccess(share.AccessLevel, share.ExpiresAt)...)
+}
+
+func checkAccess(accessLevel, expiresAt string) []string {
+	var problems []string
+	if _, err := ParseAccessLevel(accessLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if expiresAt != "" {
+		if _, err := ParseDate(expiresAt); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
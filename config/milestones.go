@@ -0,0 +1,51 @@
+package config
+
+import "fmt"
+
+const (
+	MilestoneActive = "active"
+	MilestoneClosed = "closed"
+)
+
+// Milestone is a milestone of a project or group, identified by title.
+// State defaults to active.
+type Milestone struct {
+	Title       string `yaml:"title"`
+	Description string `yaml:"description,omitempty"`
+	StartDate   string `yaml:"start_date,omitempty"`
+	DueDate     string `yaml:"due_date,omitempty"`
+	State       string `yaml:"state,omitempty"`
+}
+
+// DesiredState returns the state of the milestone, active when not set.
+func (m Milestone) DesiredState() string {
+	if m.State == "" {
+		return MilestoneActive
+	}
+	return m.State
+}
+
+// CheckMilestone returns the reasons the milestone cannot be applied.
+func CheckMilestone(milestone Milestone) []string {
+	var problems []string
+	if milestone.Title == "" {
+		problems = append(problems, "title is required")
+	}
+	if s := milestone.DesiredState(); s != MilestoneActive && s != MilestoneClosed {
+		problems = append(problems, fmt.Sprintf("state must be %s or %s", MilestoneActive, MilestoneClosed))
+	}
+
+	dates := map[string]string{"start_date": milestone.StartDate, "due_date": milestone.DueDate}
+	for _, field := range []string{"start_date", "due_date"} {
+		if dates[field] == "" {
+			continue
+		}
+		if _, err := ParseDate(dates[field]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be a date like %s", field, dateLayout))
+		}
+	}
+	if milestone.StartDate != "" && milestone.DueDate != "" && milestone.DueDate < milestone.StartDate {
+		problems = append(problems, "due_date is before start_date")
+	}
+	return problems
+}
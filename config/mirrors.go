@@ -0,0 +1,107 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+)
+
+// MirrorCredentials authenticate a mirror over HTTP(S). The password is
+// best taken from a secret provider, it is never logged.
+type MirrorCredentials struct {
+	Username     string     `yaml:"username,omitempty"`
+	Password     string     `yaml:"password,omitempty"`
+	PasswordFrom *ValueFrom `yaml:"password_from,omitempty"`
+}
+
+// Mirror is a push mirror of a project, identified by its URL without
+// credentials. Enabled defaults to true.
+type Mirror struct {
+	URL                   string `yaml:"url"`
+	MirrorCredentials     `yaml:",inline"`
+	Enabled               *bool `yaml:"enabled,omitempty"`
+	OnlyProtectedBranches bool  `yaml:"only_protected_branches,omitempty"`
+	KeepDivergentRefs     bool  `yaml:"keep_divergent_refs,omitempty"`
+}
+
+// PullMirror makes a project mirror another repository. Enabled defaults to
+// true, false stops mirroring.
+type PullMirror struct {
+	URL                        string `yaml:"url"`
+	MirrorCredentials          `yaml:",inline"`
+	Enabled                    *bool `yaml:"enabled,omitempty"`
+	TriggerBuilds              bool  `yaml:"trigger_builds,omitempty"`
+	OnlyProtectedBranches      bool  `yaml:"only_protected_branches,omitempty"`
+	OverwritesDivergedBranches bool  `yaml:"overwrites_diverged_branches,omitempty"`
+}
+
+// IsEnabled reports whether mirroring is enabled, which is the default.
+func (m Mirror) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// IsEnabled reports whether mirroring is enabled, which is the default.
+func (m PullMirror) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// AuthenticatedURL returns rawURL with the credentials set, resolving the
+// password from its provider. The result must never be logged.
+func (c MirrorCredentials) AuthenticatedURL(rawURL string) (string, error) {
+	if c.Username == "" && c.Password == "" && c.PasswordFrom == nil {
+		return rawURL, nil
+	}
+	password, err := ResolveValue(Variable{Key: "password", Value: c.Password, ValueFrom: c.PasswordFrom})
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(c.Username, password)
+	return u.String(), nil
+}
+
+// StripCredentials returns rawURL without user and password, as GitLab
+// shows mirror URLs with masked credentials. Everything up to the last @ is
+// dropped from a URL which cannot be parsed, so it is still safe to log.
+func StripCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		at := strings.LastIndex(rawURL, "@")
+		if at < 0 {
+			return rawURL
+		}
+		if scheme := strings.Index(rawURL, "://"); scheme >= 0 && scheme < at {
+			return rawURL[:scheme+3] + rawURL[at+1:]
+		}
+		return rawURL[at+1:]
+	}
+	if u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// CheckMirror returns the reasons the mirror cannot be applied.
+func CheckMirror(rawURL string, credentials MirrorCredentials) []string {
+	var problems []string
+	u, err := url.Parse(rawURL)
+	switch {
+	case rawURL == "":
+		problems = append(problems, "url is required")
+	case err != nil:
+		// The parse error quotes the URL, which may hold credentials
+		problems = append(problems, "url is invalid")
+	case u.User != nil:
+		problems = append(problems, "url must not contain credentials, use username and password_from")
+	}
+	if credentials.Password != "" && credentials.PasswordFrom != nil {
+		problems = append(problems, "password and password_from are mutually exclusive")
+	}
+	if (credentials.Password != "" || credentials.PasswordFrom != nil) && credentials.Username == "" {
+		problems = append(problems, "username is required with a password")
+	}
+	return problems
+}
@@ -12,22 +12,58 @@ import (
 )
 
 type GitlabElement struct {
-	Name               string         `yaml:"name"`
-	NameOld            string         `yaml:"name_old"`
-	Namespace          string         `yaml:"namespace"`
-	NamespaceOld       string         `yaml:"namespace_old"`
-	State              string         `yaml:"state"`
-	Description        string         `yaml:"description"`
-	Visibility         string         `yaml:"visibility,omitempty"`
-	Avatar             string         `yaml:"avatar,omitempty"`
-	CleanUnmanagedVars bool           `yaml:"clean_unmanaged_variables"`
-	CIConfigPath       string         `yaml:"ci_config_path,omitempty"`
-	Sched              []Sched        `yaml:"sched,omitempty"`
-	VariablesFile      string         `yaml:"variables_file,omitempty"`
-	Variables          []Variable     `yaml:"variables,omitempty"`
-	DeployFreezes      []DeployFreeze `yaml:"deploy_freeze,omitempty"`
-	Hooks              []Hook         `yaml:"webhooks,omitempty"`
-	HooksFile          string         `yaml:"webhooks_file,omitempty"`
+	Name                   string            `yaml:"name"`
+	NameOld                string            `yaml:"name_old,omitempty"`
+	Namespace              string            `yaml:"namespace"`
+	NamespaceOld           string            `yaml:"namespace_old,omitempty"`
+	State                  string            `yaml:"state"`
+	Description            string            `yaml:"description"`
+	Visibility             string            `yaml:"visibility,omitempty"`
+	Avatar                 string            `yaml:"avatar,omitempty"`
+	CleanUnmanagedVars     bool              `yaml:"clean_unmanaged_variables"`
+	CIConfigPath           string            `yaml:"ci_config_path,omitempty"`
+	Sched                  []Sched           `yaml:"sched,omitempty"`
+	VariablesFile          VariablesFile     `yaml:"variables_file,omitempty"`
+	Variables              []Variable        `yaml:"variables,omitempty"`
+	DeployFreezes          []DeployFreeze    `yaml:"deploy_freeze,omitempty"`
+	Hooks                  []Hook            `yaml:"webhooks,omitempty"`
+	HooksFile              string            `yaml:"webhooks_file,omitempty"`
+	Members                []Member          `yaml:"members,omitempty"`
+	CleanUnmanagedMembers  bool              `yaml:"clean_unmanaged_members,omitempty"`
+	SharedWithGroups       []SharedGroup     `yaml:"shared_with_groups,omitempty"`
+	CleanUnmanagedShares   bool              `yaml:"clean_unmanaged_shared_groups,omitempty"`
+	LDAPLinks              []LDAPLink        `yaml:"ldap_links,omitempty"`
+	CleanUnmanagedLDAP     bool              `yaml:"clean_unmanaged_ldap_links,omitempty"`
+	SAMLLinks              []SAMLLink        `yaml:"saml_links,omitempty"`
+	CleanUnmanagedSAML     bool              `yaml:"clean_unmanaged_saml_links,omitempty"`
+	ProtectedBranches      []ProtectedBranch `yaml:"protected_branches,omitempty"`
+	CleanUnmanagedBranches bool              `yaml:"clean_unmanaged_protected_branches,omitempty"`
+	ProtectedTags          []ProtectedTag    `yaml:"protected_tags,omitempty"`
+	CleanUnmanagedTags     bool              `yaml:"clean_unmanaged_protected_tags,omitempty"`
+	Approvals              *Approvals        `yaml:"approvals,omitempty"`
+	PushRules              *PushRules        `yaml:"push_rules,omitempty"`
+	DeployKeys             []DeployKey       `yaml:"deploy_keys,omitempty"`
+	CleanUnmanagedKeys     bool              `yaml:"clean_unmanaged_deploy_keys,omitempty"`
+	DeployTokens           []Token           `yaml:"deploy_tokens,omitempty"`
+	CleanDeployTokens      bool              `yaml:"clean_unmanaged_deploy_tokens,omitempty"`
+	AccessTokens           []Token           `yaml:"access_tokens,omitempty"`
+	CleanAccessTokens      bool              `yaml:"clean_unmanaged_access_tokens,omitempty"`
+	Labels                 []Label           `yaml:"labels,omitempty"`
+	CleanUnmanagedLabels   bool              `yaml:"clean_unmanaged_labels,omitempty"`
+	Milestones             []Milestone       `yaml:"milestones,omitempty"`
+	Badges                 []Badge           `yaml:"badges,omitempty"`
+	CleanUnmanagedBadges   bool              `yaml:"clean_unmanaged_badges,omitempty"`
+	Environments           []Environment     `yaml:"environments,omitempty"`
+	ProtectedEnvironments  []ProtectedEnv    `yaml:"protected_environments,omitempty"`
+	CleanProtectedEnvs     bool              `yaml:"clean_unmanaged_protected_environments,omitempty"`
+	Triggers               []Trigger         `yaml:"triggers,omitempty"`
+	CleanUnmanagedTriggers bool              `yaml:"clean_unmanaged_triggers,omitempty"`
+	JobTokenScope          *JobTokenScope    `yaml:"ci_job_token_scope,omitempty"`
+	Mirrors                []Mirror          `yaml:"mirrors,omitempty"`
+	CleanUnmanagedMirrors  bool              `yaml:"clean_unmanaged_mirrors,omitempty"`
+	PullMirror             *PullMirror       `yaml:"pull_mirror,omitempty"`
+	ContainerPolicy        *ContainerPolicy  `yaml:"container_expiration_policy,omitempty"`
+	RegistrySettings       *RegistrySettings `yaml:"registry_settings,omitempty"`
 }
 
 type DeployFreeze struct {
@@ -44,13 +80,17 @@ type Sched struct {
 }
 
 type Variable struct {
-	Key          string `yaml:"key"`
-	State        string `yaml:"state,omitempty"`
-	VariableType string `yaml:"variable_type"`
-	Protected    bool   `yaml:"protected,omitempty"`
-	Masked       bool   `yaml:"masked,omitempty"`
-	Environment  string `yaml:"environment,omitempty"`
-	Value        string `yaml:"value"`
+	Key          string     `yaml:"key"`
+	State        string     `yaml:"state,omitempty"`
+	VariableType string     `yaml:"variable_type"`
+	Protected    bool       `yaml:"protected,omitempty"`
+	Masked       bool       `yaml:"masked,omitempty"`
+	Hidden       bool       `yaml:"hidden,omitempty"`
+	Raw          bool       `yaml:"raw,omitempty"`
+	Environment  string     `yaml:"environment,omitempty"`
+	Description  string     `yaml:"description,omitempty"`
+	Value        string     `yaml:"value"`
+	ValueFrom    *ValueFrom `yaml:"value_from,omitempty"`
 }
 
 type FileVariables struct {
@@ -83,9 +123,24 @@ const (
 	yamlExt = ".yaml"
 )
 
+// Instance holds settings of the GitLab instance itself. Managing them needs
+// an administrator token.
+type Instance struct {
+	CleanUnmanagedVars bool          `yaml:"clean_unmanaged_variables,omitempty"`
+	VariablesFile      VariablesFile `yaml:"variables_file,omitempty"`
+	Variables          []Variable    `yaml:"variables,omitempty"`
+}
+
+// IsEmpty reports whether nothing is declared for the instance, in which
+// case it is left alone.
+func (i Instance) IsEmpty() bool {
+	return !i.CleanUnmanagedVars && i.VariablesFile.Path == "" && len(i.Variables) == 0
+}
+
 type GACFile struct {
-	Groups   []GitlabElement `yaml:"groups"`
-	Projects []GitlabElement `yaml:"projects"`
+	Instance *Instance       `yaml:"instance,omitempty"`
+	Groups   []GitlabElement `yaml:"groups,omitempty"`
+	Projects []GitlabElement `yaml:"projects,omitempty"`
 }
 
 func readFile(root string, file fs.FileInfo) ([]byte, error) {
@@ -109,18 +164,19 @@ func unmarshal(data []byte) (*GACFile, error) {
 	return &gac, nil
 }
 
-func ParseYaml(rootDir string) ([]GitlabElement, []GitlabElement, error) {
+func ParseYaml(rootDir string) ([]GitlabElement, []GitlabElement, Instance, error) {
 	files, err := ioutil.ReadDir(rootDir)
 	if err != nil {
 		logger.WithFields(logger.Fields{
 			"Error":   err,
 			"ReadDir": rootDir,
 		}).Error("Error occured")
-		return nil, nil, err
+		return nil, nil, Instance{}, err
 	}
 
 	var groups []GitlabElement
 	var projects []GitlabElement
+	var instance Instance
 
 	for _, file := range files {
 		data, err := readFile(rootDir, file)
@@ -143,27 +199,35 @@ func ParseYaml(rootDir string) ([]GitlabElement, []GitlabElement, error) {
 
 		groups = append(groups, gac.Groups...)
 		projects = append(projects, gac.Projects...)
+		if gac.Instance != nil {
+			mergeInstance(&instance, *gac.Instance, file.Name())
+		}
 	}
 
-	return groups, projects, nil
+	return groups, projects, instance, nil
 }
 
-func ParseVariableFile(filePath string) (FileVariables, error) {
-	var fileVariables FileVariables
-	fileBytes, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return fileVariables, err
+// mergeInstance lets the instance section be split across files. Variables
+// are concatenated, the variables_file may be declared only once.
+func mergeInstance(instance *Instance, from Instance, fileName string) {
+	instance.CleanUnmanagedVars = instance.CleanUnmanagedVars || from.CleanUnmanagedVars
+	instance.Variables = append(instance.Variables, from.Variables...)
+	if from.VariablesFile.Path == "" {
+		return
 	}
-
-	err = yaml.Unmarshal(fileBytes, &fileVariables)
-	if err != nil {
-		return fileVariables, err
+	if instance.VariablesFile.Path != "" {
+		logger.WithFields(logger.Fields{
+			"File":          fileName,
+			"VariablesFile": from.VariablesFile.Path,
+		}).Error("Instance variables_file is already declared, ignoring")
+		return
 	}
-	return fileVariables, nil
+	instance.VariablesFile = from.VariablesFile
 }
+
 func ParseHooksFile(filePath string) (FileHooks, error) {
 	var FileHooks FileHooks
-	fileBytes, err := ioutil.ReadFile(filePath)
+	fileBytes, err := ReadSecretFile(filePath)
 	if err != nil {
 		return FileHooks, err
 	}
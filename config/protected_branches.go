@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// ProtectedBranch protects the branches matching Name, which may contain
+// wildcards like "release/*".
+type ProtectedBranch struct {
+	Name                      string          `yaml:"name"`
+	PushAccessLevel           string          `yaml:"push_access_level,omitempty"`
+	MergeAccessLevel          string          `yaml:"merge_access_level,omitempty"`
+	UnprotectAccessLevel      string          `yaml:"unprotect_access_level,omitempty"`
+	AllowedToPush             []AllowedAccess `yaml:"allowed_to_push,omitempty"`
+	AllowedToMerge            []AllowedAccess `yaml:"allowed_to_merge,omitempty"`
+	AllowedToUnprotect        []AllowedAccess `yaml:"allowed_to_unprotect,omitempty"`
+	AllowForcePush            bool            `yaml:"allow_force_push,omitempty"`
+	CodeOwnerApprovalRequired bool            `yaml:"code_owner_approval_required,omitempty"`
+}
+
+// AllowedAccess allows a single user, group or deploy key, the latter
+// referenced by its title.
+type AllowedAccess struct {
+	User      string `yaml:"user,omitempty"`
+	Group     string `yaml:"group,omitempty"`
+	DeployKey string `yaml:"deploy_key,omitempty"`
+}
+
+var protectionLevels = map[string]gitlab.AccessLevelValue{
+	"no_access":  gitlab.NoPermissions,
+	"developer":  gitlab.DeveloperPermissions,
+	"maintainer": gitlab.MaintainerPermissions,
+	"admin":      gitlab.AccessLevelValue(60),
+}
+
+// ParseProtectionLevel converts the name of a push, merge or unprotect
+// access level to the value used by the API.
+func ParseProtectionLevel(name string) (gitlab.AccessLevelValue, error) {
+	level, ok := protectionLevels[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(protectionLevels))
+		for n := range protectionLevels {
+			names = append(names, n)
+		}
+		sort.Slice(names, func(i, j int) bool { return protectionLevels[names[i]] < protectionLevels[names[j]] })
+		return 0, fmt.Errorf("unknown access level %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return level, nil
+}
+
+// ProtectionLevelName is the reverse of ParseProtectionLevel.
+func ProtectionLevelName(level gitlab.AccessLevelValue) string {
+	for name, l := range protectionLevels {
+		if l == level {
+			return name
+		}
+	}
+	return fmt.Sprint(int(level))
+}
+
+// CheckAllowedAccess returns the reasons the access rules cannot be applied.
+func CheckAllowedAccess(level string, allowed []AllowedAccess) []string {
+	var problems []string
+	if level != "" {
+		if _, err := ParseProtectionLevel(level); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, a := range allowed {
+		set := 0
+		for _, v := range []string{a.User, a.Group, a.DeployKey} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			problems = append(problems, "exactly one of user, group and deploy_key is required")
+		}
+	}
+	return problems
+}
+
+// CheckProtectedBranch returns the reasons the protection cannot be applied.
+func CheckProtectedBranch(branch ProtectedBranch) []string {
+	var problems []string
+	if branch.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	problems = append(problems, CheckAllowedAccess(branch.PushAccessLevel, branch.AllowedToPush)...)
+	problems = append(problems, CheckAllowedAccess(branch.MergeAccessLevel, branch.AllowedToMerge)...)
+	problems = append(problems, CheckAllowedAccess(branch.UnprotectAccessLevel, branch.AllowedToUnprotect)...)
+	return problems
+}
@@ -0,0 +1,24 @@
+package config
+
+// ProtectedTag restricts who may create the tags matching Name, which may
+// contain wildcards like "v*".
+type ProtectedTag struct {
+	Name              string          `yaml:"name"`
+	CreateAccessLevel string          `yaml:"create_access_level,omitempty"`
+	AllowedToCreate   []AllowedAccess `yaml:"allowed_to_create,omitempty"`
+}
+
+// CheckProtectedTag returns the reasons the protection cannot be applied.
+func CheckProtectedTag(tag ProtectedTag) []string {
+	var problems []string
+	if tag.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	problems = append(problems, CheckAllowedAccess(tag.CreateAccessLevel, tag.AllowedToCreate)...)
+	for _, a := range tag.AllowedToCreate {
+		if a.DeployKey != "" {
+			problems = append(problems, "deploy keys cannot be allowed to create protected tags")
+		}
+	}
+	return problems
+}
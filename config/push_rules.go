@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PushRules are the push rules of a project or group. The block is managed
+// as a whole, settings left out are turned off. With state absent the push
+// rules are removed.
+type PushRules struct {
+	State                      string `yaml:"state,omitempty"`
+	CommitMessageRegex         string `yaml:"commit_message_regex,omitempty"`
+	CommitMessageNegativeRegex string `yaml:"commit_message_negative_regex,omitempty"`
+	BranchNameRegex            string `yaml:"branch_name_regex,omitempty"`
+	AuthorEmailRegex           string `yaml:"author_email_regex,omitempty"`
+	FileNameRegex              string `yaml:"file_name_regex,omitempty"`
+	MaxFileSize                int    `yaml:"max_file_size,omitempty"`
+	DenyDeleteTag              bool   `yaml:"deny_delete_tag,omitempty"`
+	PreventSecrets             bool   `yaml:"prevent_secrets,omitempty"`
+	MemberCheck                bool   `yaml:"member_check,omitempty"`
+	CommitCommitterCheck       bool   `yaml:"commit_committer_check,omitempty"`
+	RejectUnsignedCommits      bool   `yaml:"reject_unsigned_commits,omitempty"`
+}
+
+// Absent reports whether the push rules are to be removed.
+func (r PushRules) Absent() bool {
+	return r.State == "absent"
+}
+
+// CheckPushRules returns the reasons the push rules cannot be applied.
+// GitLab evaluates the expressions with RE2, the syntax of Go regexp.
+func CheckPushRules(rules PushRules) []string {
+	var problems []string
+	if rules.State != "" && rules.State != "present" && rules.State != "absent" {
+		problems = append(problems, fmt.Sprintf("unknown state %q, expected present or absent", rules.State))
+	}
+	expressions := []struct {
+		field string
+		value string
+	}{
+		{"commit_message_regex", rules.CommitMessageRegex},
+		{"commit_message_negative_regex", rules.CommitMessageNegativeRegex},
+		{"branch_name_regex", rules.BranchNameRegex},
+		{"author_email_regex", rules.AuthorEmailRegex},
+		{"file_name_regex", rules.FileNameRegex},
+	}
+	for _, e := range expressions {
+		if _, err := regexp.Compile(e.value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not a valid expression: %s", e.field, err))
+		}
+	}
+	if rules.MaxFileSize < 0 {
+		problems = append(problems, "max_file_size must not be negative")
+	}
+	return problems
+}
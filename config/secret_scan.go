@@ -0,0 +1,162 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const defaultAllowlistFile = ".secrets-allowlist.yml"
+
+var knownSecretPatterns = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"GitLab personal access token", regexp.MustCompile(`\bglpat-[0-9A-Za-z_\-]{20,}`)},
+	{"GitLab deploy token", regexp.MustCompile(`\bgldt-[0-9A-Za-z_\-]{20,}`)},
+	{"GitLab runner token", regexp.MustCompile(`\b(glrt-|GR1348941)[0-9A-Za-z_\-]{20,}`)},
+	{"GitLab pipeline trigger token", regexp.MustCompile(`\bglptt-[0-9a-f]{40}`)},
+	{"GitLab OAuth application secret", regexp.MustCompile(`\bgloas-[0-9a-f]{64}`)},
+	{"GitHub token", regexp.MustCompile(`\b(ghp|gho|ghu|ghs|ghr)_[0-9A-Za-z]{36}|\bgithub_pat_[0-9A-Za-z_]{82}`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[0-9A-Za-z\-]{10,}`)},
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}`)},
+	{"Stripe secret key", regexp.MustCompile(`\b(sk|rk)_live_[0-9A-Za-z]{24,}`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)},
+}
+
+var (
+	secretCandidate = regexp.MustCompile(`[A-Za-z0-9+/=_\-]{20,}`)
+	hexCandidate    = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	hasDigit        = regexp.MustCompile(`[0-9]`)
+)
+
+// Shannon entropy thresholds in bits per character for base64 and hex
+// alphabets. Words without digits are skipped: long identifiers and paths
+// reach the base64 threshold as well.
+const (
+	base64EntropyThreshold = 4.0
+	hexEntropyThreshold    = 3.0
+	minHexSecretLength     = 32
+)
+
+// DetectSecret reports why value looks like a credential, or an empty string
+// when it does not.
+func DetectSecret(value string) string {
+	for _, p := range knownSecretPatterns {
+		if p.pattern.MatchString(value) {
+			return p.name
+		}
+	}
+
+	for _, word := range secretCandidate.FindAllString(value, -1) {
+		if hexCandidate.MatchString(word) {
+			if len(word) >= minHexSecretLength && shannonEntropy(word) >= hexEntropyThreshold {
+				return "high entropy hex string"
+			}
+			continue
+		}
+		if hasDigit.MatchString(word) && shannonEntropy(word) >= base64EntropyThreshold {
+			return "high entropy string"
+		}
+	}
+	return ""
+}
+
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+	var entropy float64
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// SecretAllowlist lists findings which are known not to be secrets. Every set
+// field of an entry has to match: `target` and `key` are globs on the group or
+// project path and on the variable key, `sha256` is the hash of the value.
+//
+//	allowlist:
+//	  - target: "test-namespace/*"
+//	    key: "PUBLIC_*"
+//	  - sha256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+type SecretAllowlist struct {
+	Allowlist []SecretAllowlistEntry `yaml:"allowlist"`
+}
+
+type SecretAllowlistEntry struct {
+	Target string `yaml:"target,omitempty"`
+	Key    string `yaml:"key,omitempty"`
+	SHA256 string `yaml:"sha256,omitempty"`
+}
+
+// LoadSecretAllowlist reads SHEEVA_SECRETS_ALLOWLIST or, by default,
+// .secrets-allowlist.yml in rootDir. A missing file is an empty allowlist.
+func LoadSecretAllowlist(rootDir string) (SecretAllowlist, error) {
+	var allowlist SecretAllowlist
+
+	file := os.Getenv("SHEEVA_SECRETS_ALLOWLIST")
+	if file == "" {
+		file = filepath.Join(rootDir, defaultAllowlistFile)
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return allowlist, nil
+	}
+	if err != nil {
+		return allowlist, err
+	}
+
+	err = yaml.Unmarshal(data, &allowlist)
+	return allowlist, err
+}
+
+// Allowed reports whether a finding for key of target with value is allowed.
+func (a SecretAllowlist) Allowed(target, key, value string) bool {
+	sum := sha256.Sum256([]byte(value))
+	valueHash := hex.EncodeToString(sum[:])
+
+	for _, e := range a.Allowlist {
+		if e == (SecretAllowlistEntry{}) {
+			continue
+		}
+		if e.Target != "" && !globMatch(e.Target, target) {
+			continue
+		}
+		if e.Key != "" && !globMatch(e.Key, key) {
+			continue
+		}
+		if e.SHA256 != "" && !strings.EqualFold(e.SHA256, valueHash) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func globMatch(pattern, name string) bool {
+	ok, err := path.Match(pattern, name)
+	return err == nil && ok
+}
+
+// IsEncryptedFile reports whether a file is stored encrypted.
+func IsEncryptedFile(filePath string) (bool, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+	return detectSecretFormat(data) != secretPlain, nil
+}
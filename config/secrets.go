@@ -0,0 +1,255 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Key material is looked up in the same places sops does, so a workstation
+// that can run `sops -d` can also run sheeva.
+const (
+	ageKeyEnv        = "SOPS_AGE_KEY"
+	ageKeyFileEnv    = "SOPS_AGE_KEY_FILE"
+	ageRecipientsEnv = "SOPS_AGE_RECIPIENTS"
+
+	ageExt       = ".age"
+	ageHeader    = "age-encryption.org/v1"
+	ageArmorHead = "-----BEGIN AGE ENCRYPTED FILE-----"
+)
+
+type secretFormat int
+
+const (
+	secretPlain secretFormat = iota
+	secretAge
+	secretSops
+)
+
+// SecretFile is a decrypted variables or webhooks file which remembers how it
+// was encrypted, so it can be sealed again after editing.
+type SecretFile struct {
+	Path      string
+	Plaintext []byte
+
+	format  secretFormat
+	armored bool
+	created bool
+}
+
+func detectSecretFormat(data []byte) secretFormat {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte(ageHeader)) || bytes.HasPrefix(trimmed, []byte(ageArmorHead)) {
+		return secretAge
+	}
+	if isSopsFile(data) {
+		return secretSops
+	}
+	return secretPlain
+}
+
+// ReadSecretFile reads a file and transparently decrypts it when it is a sops
+// document or an age encrypted file. Plain files are returned as is.
+func ReadSecretFile(filePath string) ([]byte, error) {
+	secret, err := OpenSecretFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return secret.Plaintext, nil
+}
+
+// OpenSecretFile decrypts an existing file. A file which does not exist yet is
+// opened as an empty secret: a plain age file for SOPS_AGE_RECIPIENTS when it
+// has the .age extension, a sops document following .sops.yaml otherwise.
+func OpenSecretFile(filePath string) (*SecretFile, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return newSecretFile(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &SecretFile{Path: filePath, format: detectSecretFormat(data)}
+	switch secret.format {
+	case secretAge:
+		secret.armored = bytes.HasPrefix(bytes.TrimSpace(data), []byte(ageArmorHead))
+		secret.Plaintext, err = decryptAge(data)
+	case secretSops:
+		secret.Plaintext, err = decryptSops(filePath)
+	default:
+		// Never pass sops ciphertext on as plain values
+		if hasSopsCiphertext(data) {
+			err = errors.New("file holds sops encrypted values but no sops metadata")
+		}
+		secret.Plaintext = data
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return secret, nil
+}
+
+func newSecretFile(filePath string) (*SecretFile, error) {
+	if filepath.Ext(filePath) == ageExt {
+		if _, err := ageRecipientsForSeal(); err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		return &SecretFile{Path: filePath, format: secretAge, armored: true, created: true}, nil
+	}
+	return &SecretFile{Path: filePath, format: secretSops, created: true}, nil
+}
+
+// Encrypted reports whether the file is stored encrypted.
+func (s *SecretFile) Encrypted() bool {
+	return s.format != secretPlain
+}
+
+// Seal encrypts plaintext the same way the file was encrypted when opened.
+func (s *SecretFile) Seal(plaintext []byte) ([]byte, error) {
+	switch s.format {
+	case secretAge:
+		recipients, err := ageRecipientsForSeal()
+		if err != nil {
+			return nil, err
+		}
+		return encryptAge(plaintext, recipients, s.armored)
+	case secretSops:
+		if s.created {
+			return encryptSops(s.Path, plaintext)
+		}
+		return sealSops(s.Path, plaintext)
+	default:
+		return plaintext, nil
+	}
+}
+
+func loadAgeIdentities() ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if key := os.Getenv(ageKeyEnv); key != "" {
+		ids, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ageKeyEnv, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	keyFile := os.Getenv(ageKeyFileEnv)
+	if keyFile == "" {
+		keyFile = defaultAgeKeyFile()
+	}
+	f, err := os.Open(keyFile)
+	switch {
+	case err == nil:
+		defer f.Close()
+		ids, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", keyFile, err)
+		}
+		identities = append(identities, ids...)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func defaultAgeKeyFile() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "sops", "age", "keys.txt")
+}
+
+func loadAgeRecipients() ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, r := range strings.Split(os.Getenv(ageRecipientsEnv), ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ageRecipientsEnv, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// Plain age files do not record their recipients. Sealing one for a guess,
+// such as the local identity, would lock every other reader out, so the
+// recipients must be given in SOPS_AGE_RECIPIENTS.
+func ageRecipientsForSeal() ([]age.Recipient, error) {
+	recipients, err := loadAgeRecipients()
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("age files do not record their recipients, set %s", ageRecipientsEnv)
+	}
+	return recipients, nil
+}
+
+func decryptAge(data []byte) ([]byte, error) {
+	identities, err := loadAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no age identities found")
+	}
+
+	var src io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(ageArmorHead)) {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func encryptAge(plaintext []byte, recipients []age.Recipient, armored bool) ([]byte, error) {
+	var buf bytes.Buffer
+	var dst io.WriteCloser = nopWriteCloser{&buf}
+	if armored {
+		dst = armor.NewWriter(&buf)
+	}
+
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// sops documents are read and written by the sops binary, so every key type
+// (age, PGP, cloud KMS, Vault), key groups and the encryption rules of the
+// file are handled exactly as sops does. Set SOPS_BINARY to use another
+// binary than the one in PATH.
+// https://github.com/getsops/sops
+
+const (
+	sopsBinaryEnv     = "SOPS_BINARY"
+	defaultSopsBinary = "sops"
+	sopsMetadataKey   = "sops"
+	sopsDotenvMac     = "sops_mac="
+	sopsCiphertext    = "ENC[AES256_GCM,"
+	sopsDefaultFormat = "yaml"
+)
+
+// sopsFormats are the file formats sops picks by extension. Files with any
+// other extension are sops YAML documents.
+var sopsFormats = map[string]string{
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".json": "json",
+	".env":  "dotenv",
+}
+
+// isSopsFile detects YAML, JSON and dotenv sops documents by their MAC.
+func isSopsFile(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), sopsDotenvMac) {
+			return true
+		}
+	}
+	var probe map[string]interface{}
+	if err := yaml.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+	metadata, ok := probe[sopsMetadataKey].(map[string]interface{})
+	return ok && metadata["mac"] != nil
+}
+
+// hasSopsCiphertext reports values encrypted by sops in a file which is not
+// detected as a sops document, such as one with its metadata stripped.
+func hasSopsCiphertext(data []byte) bool {
+	return bytes.Contains(data, []byte(sopsCiphertext))
+}
+
+func sopsBinary() string {
+	if binary := os.Getenv(sopsBinaryEnv); binary != "" {
+		return binary
+	}
+	return defaultSopsBinary
+}
+
+// sopsFormatArgs tells sops the format of a file it cannot guess from the
+// extension.
+func sopsFormatArgs(filePath string) []string {
+	if _, ok := sopsFormats[strings.ToLower(filepath.Ext(filePath))]; ok {
+		return nil
+	}
+	return []string{"--input-type", sopsDefaultFormat, "--output-type", sopsDefaultFormat}
+}
+
+func runSops(env []string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(sopsBinary(), args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("sops is required for sops encrypted files: %w", err)
+		}
+		return nil, fmt.Errorf("sops: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func decryptSops(filePath string) ([]byte, error) {
+	args := append([]string{"--decrypt"}, sopsFormatArgs(filePath)...)
+	return runSops(nil, append(args, filePath)...)
+}
+
+// sealSops replaces the content of an existing sops document. sops edits the
+// document with plaintext copied in by the editor, so the data key, the
+// recipients and the MAC stay as sops maintains them.
+func sealSops(filePath string, plaintext []byte) ([]byte, error) {
+	original, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	// sops refuses to save a document which has not changed
+	current, err := decryptSops(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(current, plaintext) {
+		return original, nil
+	}
+
+	work, err := sopsWorkFile(filePath, original)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(work)
+
+	source, err := sopsWorkFile(filePath, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(source)
+
+	// Editing is the default command of every sops version
+	editor := "EDITOR=cp " + shellQuote(source)
+	if _, err := runSops([]string{editor}, append(sopsFormatArgs(filePath), work)...); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(work)
+}
+
+// encryptSops creates a sops document. The creation rules of .sops.yaml are
+// matched against filePath, SOPS_AGE_RECIPIENTS is used otherwise. This
+// needs sops 3.8 or newer.
+func encryptSops(filePath string, plaintext []byte) ([]byte, error) {
+	source, err := sopsWorkFile(filePath, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(source)
+
+	args := append([]string{"--encrypt", "--filename-override", filePath}, sopsFormatArgs(filePath)...)
+	return runSops(nil, append(args, source)...)
+}
+
+// sopsWorkFile writes data to a private temporary file with the extension of
+// filePath, which sops uses to tell the format.
+func sopsWorkFile(filePath string, data []byte) (string, error) {
+	f, err := os.CreateTemp("", "sheeva-sops-*"+filepath.Ext(filePath))
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/sops/variables.yaml was encrypted by sops 3.9 for two age
+// recipients, only the first key is in testdata/sops/keys.txt.
+const (
+	sopsFixture        = "testdata/sops/variables.yaml"
+	sopsTestRecipient  = "age1uy2jyu03krtkj3w2jjsy8dmm40m23xyy8kn6nzmcarf0f5t49gesdxltug"
+	sopsOtherRecipient = "age16paye4jzgzwvt5pfa8saqw5jnv6532hjra60zg5p9l6ns0ufxvusmvgl6k"
+)
+
+func requireSops(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath(sopsBinary()); err != nil {
+		t.Skipf("sops is not installed, set %s to run this test", sopsBinaryEnv)
+	}
+	keyFile, err := filepath.Abs("testdata/sops/keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sops fails on a set but empty SOPS_AGE_KEY
+	unsetEnv(t, ageKeyEnv)
+	unsetEnv(t, ageRecipientsEnv)
+	t.Setenv(ageKeyFileEnv, keyFile)
+}
+
+func unsetEnv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(sopsFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filePath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestOpenSopsFile(t *testing.T) {
+	requireSops(t)
+
+	secret, err := OpenSecretFile(sopsFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secret.Encrypted() {
+		t.Error("sops file is not reported as encrypted")
+	}
+	for _, want := range []string{"# Deploy credentials", "value: s3cr3t", "value: 0.1", "value: 1000"} {
+		if !strings.Contains(string(secret.Plaintext), want) {
+			t.Errorf("plaintext does not contain %q:\n%s", want, secret.Plaintext)
+		}
+	}
+}
+
+func TestSealSopsFileKeepsMetadata(t *testing.T) {
+	requireSops(t)
+	filePath := copyFixture(t, "variables.yaml")
+
+	secret, err := OpenSecretFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := bytes.Replace(secret.Plaintext, []byte("s3cr3t"), []byte("n3w-s3cr3t"), 1)
+	sealed, err := secret.Seal(edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recipient without a local key must still be able to decrypt
+	for _, recipient := range []string{sopsTestRecipient, sopsOtherRecipient} {
+		if !strings.Contains(string(sealed), recipient) {
+			t.Errorf("recipient %s was dropped", recipient)
+		}
+	}
+	if bytes.Contains(sealed, []byte("rotated yearly")) {
+		t.Error("comments are stored unencrypted")
+	}
+
+	// sops itself checks the MAC, comments and floats included
+	reopened, err := OpenSecretFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.Plaintext, edited) {
+		t.Errorf("plaintext = %s, want %s", reopened.Plaintext, edited)
+	}
+}
+
+func TestSealUnchangedSopsFile(t *testing.T) {
+	requireSops(t)
+	filePath := copyFixture(t, "variables.yaml")
+
+	secret, err := OpenSecretFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := secret.Seal(secret.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(sopsFixture)
+	if !bytes.Equal(sealed, original) {
+		t.Error("an unchanged file was encrypted again")
+	}
+}
+
+func TestCreateSopsFile(t *testing.T) {
+	requireSops(t)
+	t.Setenv(ageRecipientsEnv, sopsTestRecipient)
+	filePath := filepath.Join(t.TempDir(), "tokens.sops")
+
+	secret, err := OpenSecretFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("tokens:\n    DEPLOY_TOKEN: glpat-test\n")
+	sealed, err := secret.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSopsFile(sealed) || bytes.Contains(sealed, []byte("glpat-test")) {
+		t.Fatalf("not a sops document:\n%s", sealed)
+	}
+	if err := os.WriteFile(filePath, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadSecretFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("plaintext = %s, want %s", got, plaintext)
+	}
+}
+
+func TestSealAgeFileRequiresRecipients(t *testing.T) {
+	t.Setenv(ageRecipientsEnv, "")
+	filePath := filepath.Join(t.TempDir(), "variables.yaml.age")
+
+	if _, err := OpenSecretFile(filePath); err == nil {
+		t.Error("a new age file was opened without recipients")
+	}
+
+	secret := &SecretFile{Path: filePath, format: secretAge}
+	if _, err := secret.Seal([]byte("variables: []\n")); err == nil {
+		t.Error("an age file was sealed without recipients")
+	}
+}
+
+// testdata/sops/variables.env is the dotenv form of the fixture, detected
+// without the sops binary.
+const sopsDotenvFixture = "testdata/sops/variables.env"
+
+func TestDetectSopsDotenvFile(t *testing.T) {
+	encrypted, err := IsEncryptedFile(sopsDotenvFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted {
+		t.Error("sops dotenv file is not reported as encrypted")
+	}
+
+	plain, err := ParsePlainVariables(VariablesFile{Path: sopsDotenvFixture})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain.Variables) != 0 {
+		t.Errorf("ParsePlainVariables() = %+v for a sops dotenv file", plain.Variables)
+	}
+}
+
+func TestOpenStrippedSopsDotenvFile(t *testing.T) {
+	data, err := os.ReadFile(sopsDotenvFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "sops_") {
+			values = append(values, line)
+		}
+	}
+	filePath := filepath.Join(t.TempDir(), "variables.env")
+	if err := os.WriteFile(filePath, []byte(strings.Join(values, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseVariableFile(VariablesFile{Path: filePath}); err == nil {
+		t.Error("sops ciphertext was read as plain values")
+	}
+}
+
+func TestOpenSopsDotenvFile(t *testing.T) {
+	requireSops(t)
+
+	fileVariables, err := ParseVariableFile(VariablesFile{Path: sopsDotenvFixture})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, v := range fileVariables.Variables {
+		values[v.Key] = v.Value
+	}
+	if values["DEPLOY_TOKEN"] != "s3cr3t" || values["RETRIES"] != "3" || len(values) != 2 {
+		t.Errorf("ParseVariableFile() = %+v", fileVariables.Variables)
+	}
+}
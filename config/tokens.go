@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token is a deploy token or a project or group access token. Username is
+// for deploy tokens only, AccessLevel for access tokens only. GitLab shows
+// the value of a token once, so it is written to Sink when it is created.
+type Token struct {
+	Name         string     `yaml:"name"`
+	Username     string     `yaml:"username,omitempty"`
+	Scopes       []string   `yaml:"scopes"`
+	AccessLevel  string     `yaml:"access_level,omitempty"`
+	ExpiresAt    string     `yaml:"expires_at,omitempty"`
+	ExpiresIn    string     `yaml:"expires_in,omitempty"`
+	RotateBefore string     `yaml:"rotate_before,omitempty"`
+	Sink         *TokenSink `yaml:"sink,omitempty"`
+}
+
+// TokenSink is where the value of a new token is written: a CI variable, a
+// plain file or a file encrypted with sops or age. Key names the token in
+// the encrypted file and defaults to the token name.
+type TokenSink struct {
+	Variable      *SinkVariable `yaml:"variable,omitempty"`
+	File          string        `yaml:"file,omitempty"`
+	EncryptedFile string        `yaml:"encrypted_file,omitempty"`
+	Key           string        `yaml:"key,omitempty"`
+}
+
+// SinkVariable is a CI variable of a project or group receiving a token.
+type SinkVariable struct {
+	Project     string `yaml:"project,omitempty"`
+	Group       string `yaml:"group,omitempty"`
+	Key         string `yaml:"key"`
+	Environment string `yaml:"environment,omitempty"`
+	Protected   bool   `yaml:"protected,omitempty"`
+	Masked      bool   `yaml:"masked,omitempty"`
+}
+
+// Target is the path of the project or group holding the variable.
+func (v SinkVariable) Target() string {
+	if v.Project != "" {
+		return v.Project
+	}
+	return v.Group
+}
+
+// ParseDuration extends time.ParseDuration with days and weeks, like 14d.
+func ParseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if strings.HasSuffix(s, suffix) {
+			count, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected a number of days like 14d", s)
+	}
+	return d, nil
+}
+
+// Expiry returns the expiry date of a token created at now, or an empty
+// string when the token does not expire.
+func (t Token) Expiry(now time.Time) string {
+	if t.ExpiresAt != "" {
+		return t.ExpiresAt
+	}
+	if t.ExpiresIn == "" {
+		return ""
+	}
+	d, err := ParseDuration(t.ExpiresIn)
+	if err != nil {
+		return ""
+	}
+	return now.Add(d).Format(dateLayout)
+}
+
+// CheckToken returns the reasons the token cannot be applied. deploy tells
+// a deploy token from an access token.
+func CheckToken(token Token, deploy bool) []string {
+	var problems []string
+	if token.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if len(token.Scopes) == 0 {
+		problems = append(problems, "scopes are required")
+	}
+	switch {
+	case deploy && token.AccessLevel != "":
+		problems = append(problems, "access_level is not supported on deploy tokens")
+	case !deploy && token.Username != "":
+		problems = append(problems, "username is only supported on deploy tokens")
+	case !deploy && token.AccessLevel != "":
+		if _, err := ParseAccessLevel(token.AccessLevel); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if token.ExpiresAt != "" {
+		if token.ExpiresIn != "" {
+			problems = append(problems, "expires_at and expires_in are mutually exclusive")
+		}
+		if _, err := ParseDate(token.ExpiresAt); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, d := range []string{token.ExpiresIn, token.RotateBefore} {
+		if d == "" {
+			continue
+		}
+		if _, err := ParseDuration(d); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	// A rotated token with a fixed date would be rotated again on every run
+	if token.RotateBefore != "" && token.ExpiresIn == "" {
+		problems = append(problems, "rotate_before needs expires_in")
+	}
+
+	if token.Sink != nil {
+		problems = append(problems, checkTokenSink(*token.Sink)...)
+		// GitLab generates gitlab+deploy-token-N, which is not stored
+		if deploy && token.Username == "" {
+			problems = append(problems, "username is required for deploy tokens with a sink")
+		}
+	}
+	return problems
+}
+
+func checkTokenSink(sink TokenSink) []string {
+	var problems []string
+	set := 0
+	for _, s := range []bool{sink.Variable != nil, sink.File != "", sink.EncryptedFile != ""} {
+		if s {
+			set++
+		}
+	}
+	if set != 1 {
+		problems = append(problems, "sink needs exactly one of variable, file or encrypted_file")
+	}
+	if v := sink.Variable; v != nil {
+		if (v.Project == "") == (v.Group == "") {
+			problems = append(problems, "sink variable needs either project or group")
+		}
+		if v.Key == "" {
+			problems = append(problems, "sink variable key is required")
+		}
+	}
+	return problems
+}
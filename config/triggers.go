@@ -0,0 +1,21 @@
+package config
+
+// Trigger is a pipeline trigger token of a project, identified by its
+// description. GitLab shows the token in full once, so it is written to
+// Sink when the trigger is created.
+type Trigger struct {
+	Description string     `yaml:"description"`
+	Sink        *TokenSink `yaml:"sink,omitempty"`
+}
+
+// CheckTrigger returns the reasons the trigger cannot be applied.
+func CheckTrigger(trigger Trigger) []string {
+	var problems []string
+	if trigger.Description == "" {
+		problems = append(problems, "description is required")
+	}
+	if trigger.Sink != nil {
+		problems = append(problems, checkTokenSink(*trigger.Sink)...)
+	}
+	return problems
+}
@@ -0,0 +1,301 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ValueFrom points a variable at a secret stored outside of the repository.
+//
+//	value_from:
+//	  provider: vault
+//	  path: "ci/test-namespace/app"
+//	  key: "DB_PASSWORD"
+type ValueFrom struct {
+	Provider string `yaml:"provider"`
+	Mount    string `yaml:"mount,omitempty"`
+	Path     string `yaml:"path"`
+	Key      string `yaml:"key,omitempty"`
+	Command  string `yaml:"command,omitempty"`
+}
+
+// SecretProvider fetches a secret document. Documents are cached for the
+// whole run, so a provider is asked at most once per document.
+type SecretProvider interface {
+	// CacheKey identifies the document ref points to.
+	CacheKey(ref ValueFrom) string
+	// Fetch returns the fields of the document ref points to.
+	Fetch(ref ValueFrom) (map[string]string, error)
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]SecretProvider{
+		"vault": vaultProvider{},
+		"file":  fileProvider{},
+		"exec":  execProvider{},
+	}
+
+	secretCacheMu sync.Mutex
+	secretCache   = map[string]*cachedSecret{}
+)
+
+// cachedSecret is a document fetched once, however many variables ask for it
+// at the same time. Failures are cached as well.
+type cachedSecret struct {
+	once sync.Once
+	doc  map[string]string
+	err  error
+}
+
+// RegisterSecretProvider makes a provider available to value_from by name.
+func RegisterSecretProvider(name string, provider SecretProvider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = provider
+}
+
+func getSecretProvider(name string) (SecretProvider, bool) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	p, ok := providers[name]
+	return p, ok
+}
+
+// ResolveValue returns the value of a variable, fetching it from its
+// value_from provider when one is set.
+func ResolveValue(variable Variable) (string, error) {
+	if variable.ValueFrom == nil {
+		return variable.Value, nil
+	}
+	ref := *variable.ValueFrom
+
+	provider, ok := getSecretProvider(ref.Provider)
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider %q", ref.Provider)
+	}
+
+	cacheKey := ref.Provider + ":" + provider.CacheKey(ref)
+	secretCacheMu.Lock()
+	cached, ok := secretCache[cacheKey]
+	if !ok {
+		cached = &cachedSecret{}
+		secretCache[cacheKey] = cached
+	}
+	secretCacheMu.Unlock()
+
+	cached.once.Do(func() {
+		cached.doc, cached.err = provider.Fetch(ref)
+	})
+	if cached.err != nil {
+		return "", fmt.Errorf("%s: %w", ref.Provider, cached.err)
+	}
+
+	value, ok := cached.doc[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("%s: key %q not found in %s", ref.Provider, ref.Key, ref.Path)
+	}
+	return value, nil
+}
+
+// ResolveVariables resolves value_from of every variable. Variables which
+// cannot be resolved are left out and reported in the returned error map,
+// keyed by VariableID.
+func ResolveVariables(variables []Variable) ([]Variable, map[string]error) {
+	var resolved []Variable
+	errs := map[string]error{}
+	for _, variable := range variables {
+		value, err := ResolveValue(variable)
+		if err != nil {
+			errs[VariableID(variable)] = err
+			continue
+		}
+		variable.Value = value
+		resolved = append(resolved, variable)
+	}
+	return resolved, errs
+}
+
+// vaultProvider reads KV version 2 secrets using VAULT_ADDR, VAULT_TOKEN
+// (or ~/.vault-token) and the optional VAULT_NAMESPACE.
+type vaultProvider struct{}
+
+const defaultVaultMount = "secret"
+
+func (vaultProvider) CacheKey(ref ValueFrom) string {
+	return vaultMount(ref) + "/" + strings.Trim(ref.Path, "/")
+}
+
+func vaultMount(ref ValueFrom) string {
+	if ref.Mount != "" {
+		return strings.Trim(ref.Mount, "/")
+	}
+	return defaultVaultMount
+}
+
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	token, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", fmt.Errorf("VAULT_TOKEN is not set: %w", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+func (vaultProvider) Fetch(ref ValueFrom) (map[string]string, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s", addr, vaultMount(ref), strings.Trim(ref.Path, "/"))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	client := &http.Client{Timeout: time.Second * 20}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	return stringifySecret(secret.Data.Data), nil
+}
+
+// fileProvider reads secrets from files under SHEEVA_SECRETS_DIR (the
+// working directory by default). Files may be encrypted with sops or age.
+// Without a key the whole file is the value, otherwise the file is parsed
+// as a YAML or JSON mapping.
+type fileProvider struct{}
+
+func (fileProvider) CacheKey(ref ValueFrom) string {
+	return ref.Path
+}
+
+func (fileProvider) Fetch(ref ValueFrom) (map[string]string, error) {
+	path := ref.Path
+	if dir := os.Getenv("SHEEVA_SECRETS_DIR"); dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	data, err := ReadSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[string]string{"": string(data)}
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal(data, &fields); err == nil {
+		for k, v := range stringifySecret(fields) {
+			doc[k] = v
+		}
+	}
+	return doc, nil
+}
+
+// execProvider runs an external plugin. The plugin receives the reference as
+// a JSON object on stdin and answers on stdout with
+// {"data": {"KEY": "value"}} or {"error": "message"}.
+type execProvider struct{}
+
+type execRequest struct {
+	Mount string `json:"mount,omitempty"`
+	Path  string `json:"path"`
+	Key   string `json:"key,omitempty"`
+}
+
+type execResponse struct {
+	Data  map[string]interface{} `json:"data"`
+	Error string                 `json:"error"`
+}
+
+func (execProvider) CacheKey(ref ValueFrom) string {
+	// The key is sent to the plugin, which may answer with that key only
+	return ref.Command + "\x00" + ref.Mount + "\x00" + ref.Path + "\x00" + ref.Key
+}
+
+func (execProvider) Fetch(ref ValueFrom) (map[string]string, error) {
+	args := strings.Fields(ref.Command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("command is not set")
+	}
+
+	request, err := json.Marshal(execRequest{Mount: ref.Mount, Path: ref.Path, Key: ref.Key})
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	var response execResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("%s: invalid response: %w", args[0], err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s: %s", args[0], response.Error)
+	}
+	return stringifySecret(response.Data), nil
+}
+
+func stringifySecret(data map[string]interface{}) map[string]string {
+	doc := make(map[string]string, len(data))
+	for k, v := range data {
+		switch v := v.(type) {
+		case string:
+			doc[k] = v
+		case nil:
+			doc[k] = ""
+		default:
+			if b, err := json.Marshal(v); err == nil {
+				doc[k] = string(b)
+			} else {
+				doc[k] = fmt.Sprint(v)
+			}
+		}
+	}
+	return doc
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func resetSecretCache() {
+	secretCacheMu.Lock()
+	secretCache = map[string]*cachedSecret{}
+	secretCacheMu.Unlock()
+}
+
+func newVaultServer(t *testing.T, requests *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Header.Get("X-Vault-Token") != "s.test" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		if got := r.Header.Get("X-Vault-Namespace"); got != "team" {
+			t.Errorf("namespace = %q, want team", got)
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/ci/app":
+			w.Write([]byte(`{"data":{"data":{"DB_PASSWORD":"s3cr3t","PORT":5432,"EMPTY":null},"metadata":{"version":3}}}`))
+		case "/v1/kv/data/ci/app":
+			w.Write([]byte(`{"data":{"data":{"DB_PASSWORD":"from-kv"}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("VAULT_ADDR", server.URL+"/")
+	t.Setenv("VAULT_TOKEN", "s.test")
+	t.Setenv("VAULT_NAMESPACE", "team")
+	return server
+}
+
+func vaultVariable(key, mount, path, field string) Variable {
+	return Variable{Key: key, ValueFrom: &ValueFrom{Provider: "vault", Mount: mount, Path: path, Key: field}}
+}
+
+func TestVaultProvider(t *testing.T) {
+	resetSecretCache()
+	var requests int32
+	newVaultServer(t, &requests)
+
+	tests := []struct {
+		name     string
+		variable Variable
+		want     string
+		wantErr  bool
+	}{
+		{"string", vaultVariable("DB", "", "ci/app", "DB_PASSWORD"), "s3cr3t", false},
+		{"number", vaultVariable("PORT", "", "/ci/app/", "PORT"), "5432", false},
+		{"null", vaultVariable("EMPTY", "", "ci/app", "EMPTY"), "", false},
+		{"mount", vaultVariable("DB", "/kv/", "ci/app", "DB_PASSWORD"), "from-kv", false},
+		{"missing key", vaultVariable("NOPE", "", "ci/app", "NOPE"), "", true},
+		{"missing path", vaultVariable("NOPE", "", "ci/none", "NOPE"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveValue(tt.variable)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// secret/ci/app, kv/ci/app and secret/ci/none, once each
+	if requests != 3 {
+		t.Errorf("vault was called %d times, want 3", requests)
+	}
+}
+
+func TestVaultProviderConcurrentFetch(t *testing.T) {
+	resetSecretCache()
+	var requests int32
+	newVaultServer(t, &requests)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ResolveValue(vaultVariable("DB", "", "ci/app", "DB_PASSWORD")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests != 1 {
+		t.Errorf("vault was called %d times, want 1", requests)
+	}
+}
+
+func TestVaultProviderDenied(t *testing.T) {
+	resetSecretCache()
+	var requests int32
+	newVaultServer(t, &requests)
+	t.Setenv("VAULT_TOKEN", "s.wrong")
+
+	if _, err := ResolveValue(vaultVariable("DB", "", "ci/app", "DB_PASSWORD")); err == nil {
+		t.Fatal("ResolveValue() succeeded with a wrong token")
+	}
+}
+
+func TestResolveVariablesErrorsByScope(t *testing.T) {
+	resetSecretCache()
+	var requests int32
+	newVaultServer(t, &requests)
+
+	prod := vaultVariable("DB", "", "ci/app", "NOPE")
+	prod.Environment = "production"
+	staging := vaultVariable("DB", "", "ci/app", "NOPE")
+	staging.Environment = "staging"
+
+	resolved, errs := ResolveVariables([]Variable{prod, staging, vaultVariable("DB", "", "ci/app", "DB_PASSWORD")})
+	if len(resolved) != 1 || resolved[0].Value != "s3cr3t" {
+		t.Errorf("resolved = %+v, want the DB@* variable only", resolved)
+	}
+	for _, id := range []string{"DB@production", "DB@staging"} {
+		if errs[id] == nil {
+			t.Errorf("no error for %s in %v", id, errs)
+		}
+	}
+}
+
+func TestExecProviderCacheKey(t *testing.T) {
+	a := ValueFrom{Provider: "exec", Command: "plugin", Path: "ci/app", Key: "A"}
+	b := a
+	b.Key = "B"
+	if (execProvider{}).CacheKey(a) == (execProvider{}).CacheKey(b) {
+		t.Error("exec cache key does not depend on the key sent to the plugin")
+	}
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const minMaskedValueLength = 8
+
+// DefaultEnvironmentScope is the scope of variables which do not set one.
+const DefaultEnvironmentScope = "*"
+
+// VariableID identifies a variable the way GitLab does: by key and
+// environment scope.
+func VariableID(v Variable) string {
+	scope := v.Environment
+	if scope == "" {
+		scope = DefaultEnvironmentScope
+	}
+	return v.Key + "@" + scope
+}
+
+var variableKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,255}$`)
+
+// Characters allowed in masked values besides the Base64 alphabet, with the
+// GitLab version which started to accept them.
+// https://docs.gitlab.com/ee/ci/variables/#mask-a-cicd-variable
+var maskedExtraChars = []struct {
+	major, minor int
+	chars        string
+}{
+	{12, 2, "@:"},
+	{12, 10, "."},
+	{13, 12, "~"},
+}
+
+// maskedCharset returns the allowed characters as a regexp character class
+// body, with '-' kept last so it is not read as a range.
+func maskedCharset(version GitlabVersion) string {
+	charset := "A-Za-z0-9_+=/"
+	for _, extra := range maskedExtraChars {
+		if version.AtLeast(extra.major, extra.minor) {
+			charset += extra.chars
+		}
+	}
+	return charset + "-"
+}
+
+// CheckVariable returns the reasons GitLab of the given version would reject
+// the variable. Values coming from value_from must be resolved beforehand.
+func CheckVariable(variable Variable, version GitlabVersion) []string {
+	var problems []string
+
+	if !variableKeyPattern.MatchString(variable.Key) {
+		problems = append(problems, "key must be 1 to 255 characters long and contain only letters, digits and '_'")
+	}
+
+	switch variable.VariableType {
+	case "", variableTypeEnvVar, variableTypeFile:
+	default:
+		problems = append(problems, fmt.Sprintf("variable_type must be %q or %q", variableTypeEnvVar, variableTypeFile))
+	}
+
+	if variable.Raw && !version.AtLeast(15, 7) {
+		problems = append(problems, fmt.Sprintf("raw variables are not supported by GitLab %s", version))
+	}
+	if variable.Description != "" && !version.AtLeast(16, 2) {
+		problems = append(problems, fmt.Sprintf("variable descriptions are not supported by GitLab %s", version))
+	}
+	if variable.Hidden {
+		if !version.AtLeast(17, 4) {
+			problems = append(problems, fmt.Sprintf("hidden variables are not supported by GitLab %s", version))
+		}
+		if !variable.Masked {
+			problems = append(problems, "hidden variables must be masked")
+		}
+	}
+
+	if variable.Masked {
+		value := variable.Value
+		if strings.ContainsAny(value, "\r\n") {
+			problems = append(problems, "masked value must be a single line")
+		}
+		if len(value) < minMaskedValueLength {
+			problems = append(problems, fmt.Sprintf("masked value must be at least %d characters long", minMaskedValueLength))
+		}
+		notAllowed := regexp.MustCompile(`[^\r\n` + maskedCharset(version) + `]`)
+		if invalid := notAllowed.FindAllString(value, -1); len(invalid) > 0 {
+			problems = append(problems, fmt.Sprintf("masked value contains characters not allowed by GitLab %s: %q", version, uniqueChars(invalid)))
+		}
+	}
+
+	return problems
+}
+
+// CheckInstanceVariable is CheckVariable for instance variables, which have
+// neither environment scopes nor hidden values.
+func CheckInstanceVariable(variable Variable, version GitlabVersion) []string {
+	problems := CheckVariable(variable, version)
+	if !version.AtLeast(13, 0) {
+		problems = append(problems, fmt.Sprintf("instance variables are not supported by GitLab %s", version))
+	}
+	if variable.Environment != "" && variable.Environment != "*" {
+		problems = append(problems, "instance variables cannot have an environment scope")
+	}
+	if variable.Hidden {
+		problems = append(problems, "instance variables cannot be hidden")
+	}
+	return problems
+}
+
+func uniqueChars(chars []string) string {
+	var b strings.Builder
+	seen := map[string]bool{}
+	for _, c := range chars {
+		if !seen[c] {
+			seen[c] = true
+			b.WriteString(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,272 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	envExt  = ".env"
+	jsonExt = ".json"
+
+	variableTypeEnvVar = "env_var"
+	variableTypeFile   = "file"
+)
+
+// VariablesFile is the `variables_file` setting. It is either a plain path or
+// a mapping with defaults for formats which cannot describe variable
+// attributes themselves (.env, flat JSON objects and directories):
+//
+//	variables_file:
+//	  path: "projects/variables/app.env"
+//	  protected: true
+//	  environment: "production"
+type VariablesFile struct {
+	Path         string `yaml:"path"`
+	VariableType string `yaml:"variable_type,omitempty"`
+	Protected    bool   `yaml:"protected,omitempty"`
+	Masked       bool   `yaml:"masked,omitempty"`
+	Environment  string `yaml:"environment,omitempty"`
+}
+
+func (f *VariablesFile) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		f.Path = value.Value
+		return nil
+	}
+	type plain VariablesFile
+	return value.Decode((*plain)(f))
+}
+
+func (f VariablesFile) MarshalYAML() (interface{}, error) {
+	if f == (VariablesFile{Path: f.Path}) {
+		return f.Path, nil
+	}
+	type plain VariablesFile
+	return plain(f), nil
+}
+
+func (f VariablesFile) variable(key, value, defaultType string) Variable {
+	variableType := f.VariableType
+	if variableType == "" {
+		variableType = defaultType
+	}
+	return Variable{
+		Key:          key,
+		VariableType: variableType,
+		Protected:    f.Protected,
+		Masked:       f.Masked,
+		Environment:  f.Environment,
+		Value:        value,
+	}
+}
+
+// ParseVariableFile reads variables from a Sheeva YAML file, a .env file, a
+// JSON file or a directory where every file becomes a file type variable.
+func ParseVariableFile(file VariablesFile) (FileVariables, error) {
+	var fileVariables FileVariables
+
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return fileVariables, err
+	}
+	if info.IsDir() {
+		return parseVariableDir(file, false)
+	}
+
+	fileBytes, err := ReadSecretFile(file.Path)
+	if err != nil {
+		return fileVariables, err
+	}
+
+	switch variablesFileExt(file.Path) {
+	case envExt:
+		return parseDotenv(file, fileBytes)
+	case jsonExt:
+		return parseJSONVariables(file, fileBytes)
+	}
+
+	err = yaml.Unmarshal(fileBytes, &fileVariables)
+	if err != nil {
+		return fileVariables, err
+	}
+	return fileVariables, nil
+}
+
+// variablesFileExt returns the format extension, ignoring a trailing .age.
+func variablesFileExt(path string) string {
+	path = strings.TrimSuffix(path, ageExt)
+	if filepath.Base(path) == envExt {
+		return envExt
+	}
+	return filepath.Ext(path)
+}
+
+// ParsePlainVariables reads the variables of a variables_file which are stored
+// unencrypted. Every file of a directory is checked on its own.
+func ParsePlainVariables(file VariablesFile) (FileVariables, error) {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return FileVariables{}, err
+	}
+	if info.IsDir() {
+		return parseVariableDir(file, true)
+	}
+
+	encrypted, err := IsEncryptedFile(file.Path)
+	if err != nil || encrypted {
+		return FileVariables{}, err
+	}
+	return ParseVariableFile(file)
+}
+
+func parseVariableDir(file VariablesFile, plainOnly bool) (FileVariables, error) {
+	var fileVariables FileVariables
+
+	entries, err := os.ReadDir(file.Path)
+	if err != nil {
+		return fileVariables, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		entryPath := filepath.Join(file.Path, entry.Name())
+		if plainOnly {
+			encrypted, err := IsEncryptedFile(entryPath)
+			if err != nil {
+				return fileVariables, err
+			}
+			if encrypted {
+				continue
+			}
+		}
+		data, err := ReadSecretFile(entryPath)
+		if err != nil {
+			return fileVariables, err
+		}
+		fileVariables.Variables = append(fileVariables.Variables,
+			file.variable(variableKeyFromFileName(entry.Name()), string(data), variableTypeFile))
+	}
+	return fileVariables, nil
+}
+
+var invalidVariableKeyChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// variableKeyFromFileName keeps the file name, replacing characters GitLab
+// does not allow in variable keys: "ca.crt" becomes "ca_crt".
+func variableKeyFromFileName(name string) string {
+	return invalidVariableKeyChars.ReplaceAllString(strings.TrimSuffix(name, ageExt), "_")
+}
+
+// parseJSONVariables accepts either the Sheeva layout ({"variables": [...]})
+// or a flat object of keys and values. JSON is valid YAML, which also lets
+// sops encrypted JSON files through after decryption.
+func parseJSONVariables(file VariablesFile, data []byte) (FileVariables, error) {
+	var fileVariables FileVariables
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fileVariables, err
+	}
+	if _, ok := doc["variables"]; ok {
+		err := yaml.Unmarshal(data, &fileVariables)
+		return fileVariables, err
+	}
+
+	values := stringifySecret(doc)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fileVariables.Variables = append(fileVariables.Variables, file.variable(k, values[k], variableTypeEnvVar))
+	}
+	return fileVariables, nil
+}
+
+// parseDotenv understands KEY=value lines with optional `export`, comments,
+// single quoted literal values and double quoted values with escapes, which
+// may span several lines.
+func parseDotenv(file VariablesFile, data []byte) (FileVariables, error) {
+	var fileVariables FileVariables
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.Index(line, "=")
+		if eq < 1 {
+			return fileVariables, fmt.Errorf("%s:%d: expected KEY=value", file.Path, lineNo)
+		}
+		key := strings.TrimSpace(line[:eq])
+		raw := strings.TrimSpace(line[eq+1:])
+
+		var value string
+		switch {
+		case strings.HasPrefix(raw, `"`):
+			end := closingDoubleQuote(raw)
+			for ; end < 0; end = closingDoubleQuote(raw) {
+				if !scanner.Scan() {
+					return fileVariables, fmt.Errorf("%s:%d: unterminated quoted value", file.Path, lineNo)
+				}
+				lineNo++
+				raw += "\n" + scanner.Text()
+			}
+			value = unescapeDotenv(raw[1:end])
+		case strings.HasPrefix(raw, `'`):
+			end := strings.LastIndex(raw, `'`)
+			if end == 0 {
+				return fileVariables, fmt.Errorf("%s:%d: unterminated quoted value", file.Path, lineNo)
+			}
+			value = raw[1:end]
+		default:
+			if i := strings.Index(raw, " #"); i >= 0 {
+				raw = raw[:i]
+			}
+			value = strings.TrimSpace(raw)
+		}
+
+		fileVariables.Variables = append(fileVariables.Variables, file.variable(key, value, variableTypeEnvVar))
+	}
+	return fileVariables, scanner.Err()
+}
+
+// closingDoubleQuote returns the index of the quote closing raw[0], or -1.
+func closingDoubleQuote(raw string) int {
+	escaped := false
+	for i := 1; i < len(raw); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case raw[i] == '\\':
+			escaped = true
+		case raw[i] == '"':
+			return i
+		}
+	}
+	return -1
+}
+
+var dotenvEscapes = strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\"`, `"`, `\\`, `\`)
+
+func unescapeDotenv(s string) string {
+	return dotenvEscapes.Replace(s)
+}
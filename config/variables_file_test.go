@@ -0,0 +1,57 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestParsePlainVariablesMixedDirectory(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := encryptAge([]byte("glpat-encrypted"), []age.Recipient{identity.Recipient()}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ageKeyEnv, identity.String())
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"deploy_token.age": sealed,
+		"ssh_key":          []byte("plain key"),
+		".hidden":          []byte("ignored"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := ParseVariableFile(VariablesFile{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Variables) != 2 {
+		t.Errorf("ParseVariableFile() = %+v, want both files", all.Variables)
+	}
+
+	plain, err := ParsePlainVariables(VariablesFile{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain.Variables) != 1 || plain.Variables[0].Value != "plain key" {
+		t.Errorf("ParsePlainVariables() = %+v, want the plain file only", plain.Variables)
+	}
+
+	encrypted, err := ParsePlainVariables(VariablesFile{Path: filepath.Join(dir, "deploy_token.age")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted.Variables) != 0 {
+		t.Errorf("ParsePlainVariables() = %+v for an encrypted file", encrypted.Variables)
+	}
+}
@@ -3,6 +3,8 @@ module sheeva
 go 1.19
 
 require (
+	filippo.io/age v1.1.1
+	github.com/hashicorp/go-retryablehttp v0.7.2
 	github.com/sirupsen/logrus v1.7.0
 	github.com/xanzy/go-gitlab v0.81.0
 	gopkg.in/yaml.v3 v3.0.1
@@ -13,8 +15,8 @@ require (
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
-	github.com/hashicorp/go-retryablehttp v0.7.2 // indirect
 	github.com/kr/text v0.2.0 // indirect
+	golang.org/x/crypto v0.4.0 // indirect
 	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/oauth2 v0.6.0 // indirect
 	golang.org/x/sys v0.6.0 // indirect
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"sheeva/cmd"
 
@@ -20,6 +21,51 @@ func main() {
 		}
 	}()
 
+	switch flag.Arg(0) {
+	case "secrets":
+		if flag.Arg(1) != "edit" || flag.Arg(2) == "" {
+			log.Fatal("Usage: sheeva secrets edit <file>")
+		}
+		if err := cmd.EditSecretFile(flag.Arg(2)); err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+				"File":  flag.Arg(2),
+			}).Fatal("Error while editing secret file")
+		}
+		return
+	case "validate":
+		if err := cmd.Validate(); err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Fatal("Validation failed")
+		}
+		return
+	case "plan":
+		if err := cmd.Plan(); err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Fatal("Plan failed")
+		}
+		return
+	case "import":
+		if flag.Arg(1) == "" {
+			log.Fatal("Usage: sheeva import <project or group path>")
+		}
+		if err := cmd.Import(flag.Arg(1)); err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+				"Path":  flag.Arg(1),
+			}).Fatal("Import failed")
+		}
+		return
+	}
+
+	if err := cmd.ManageInstance(); err != nil {
+		log.WithFields(log.Fields{
+			"Error": err,
+		}).Error("Error while managing instance")
+	}
+
 	if err := cmd.ManageGroups(); err != nil {
 		log.WithFields(log.Fields{
 			"Error": err,